@@ -3,10 +3,13 @@ package main
 import (
 	"WB1/libr"
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -14,9 +17,59 @@ import (
 )
 
 func main() {
-	fmt.Println(time.Now(), "Work is beginning.")
+	// Настройки подписки можно поменять флагами, по умолчанию значения для локального docker-compose
+	var Stream libr.StreamConfig
+	flag.StringVar(&Stream.ClusterID, "cluster", "test-cluster", "nats-streaming cluster id")
+	flag.StringVar(&Stream.ClientID, "client", "client-123", "nats-streaming client id")
+	flag.StringVar(&Stream.URL, "nats", "0.0.0.0:4222", "nats server url")
+	flag.StringVar(&Stream.Subject, "subject", "foo", "channel with orders")
+	flag.StringVar(&Stream.DurableName, "durable", "orders-durable", "durable subscription name")
+	flag.DurationVar(&Stream.AckWait, "ack-wait", 30*time.Second, "time before unacknowledged message is redelivered")
+	flag.IntVar(&Stream.MaxInflight, "max-inflight", 16, "max unacknowledged messages in flight")
+	flag.IntVar(&Stream.MaxRedeliveries, "max-redeliveries", 10, "redeliveries of a message failing to store before it goes to dead-letter, 0 means no limit")
+	flag.StringVar(&Stream.DeadLetterSubject, "dead-letter", "foo.dead-letter", "channel for rejected messages")
+	flag.StringVar(&Stream.InvalidationSubject, "invalidation", "orders.invalidate", "nats subject for cache invalidation between instances, empty disables")
+	AutoMigrate := flag.Bool("auto-migrate", true, "apply pending schema migrations at startup")
+	// Ограничения кэша, чтобы память сервиса не росла под постоянной нагрузкой
+	CacheOpts := libr.CacheOptions[string, libr.Order]{DefaultExpiration: 15 * time.Minute, CleanupInterval: 3 * time.Minute}
+	flag.IntVar(&CacheOpts.MaxEntries, "cache-max-entries", 10000, "max orders in cache, 0 means no limit")
+	flag.Int64Var(&CacheOpts.MaxBytes, "cache-max-bytes", 64<<20, "approximate cache size limit in bytes, 0 means no limit")
+	CachePolicy := flag.String("cache-policy", libr.PolicyLRU, "cache eviction policy: lru, lfu or ttl")
+	flag.DurationVar(&CacheOpts.NegativeTTL, "cache-negative-ttl", 30*time.Second, "how long a missing order is remembered in cache, 0 disables")
+	CacheShards := flag.Int("cache-shards", 16, "number of cache shards with separate locks, 1 disables sharding")
+	RefreshRecent := flag.Duration("cache-refresh-recent", 0, "reload expired orders created within this time from database, 0 disables")
+	// Снимок кэша на диске, чтобы после перезапуска не перечитывать заказы из БД
+	SnapshotFile := flag.String("snapshot-file", "cache.snapshot", "file with cache snapshot, empty disables snapshots")
+	SnapshotInterval := flag.Duration("snapshot-interval", time.Minute, "how often cache snapshot is saved")
+	SnapshotMaxAge := flag.Duration("snapshot-max-age", 10*time.Minute, "snapshot older than this is ignored at startup, 0 means any age")
+	// Прогрев кэша из БД, если снимка нет
+	var Warm libr.WarmUpConfig
+	flag.StringVar(&Warm.Strategy, "warmup", libr.WarmUpRecent, "cache warm-up strategy: recent, window, all or none")
+	flag.IntVar(&Warm.Count, "warmup-count", 1000, "number of most recent orders loaded by recent warm-up")
+	flag.DurationVar(&Warm.Window, "warmup-window", 24*time.Hour, "orders created within this time are loaded by window warm-up")
+	flag.BoolVar(&Warm.Background, "warmup-background", true, "warm up cache in background while server is already serving")
+	flag.Parse()
+
+	// Политика создается отдельно для каждой части кэша, поэтому передаем не саму политику, а способ ее создать
 	var err error
-	var ServStruck = libr.NewSkz(libr.Connector{Uname: "postgres", Pass: "postgres", Host: "localhost", Port: "5432", Dbname: "postgres"}, 15*time.Minute, 3*time.Minute)
+	_, err = libr.NewEvictionPolicy[string](*CachePolicy)
+	if err == nil {
+		err = Warm.Check()
+	}
+	if err != nil {
+		fmt.Println(time.Now(), "Bad cache settings:", err)
+		os.Exit(1)
+	}
+	CacheOpts.NewPolicy = func() libr.EvictionPolicy[string] {
+		policy, _ := libr.NewEvictionPolicy[string](*CachePolicy)
+		return policy
+	}
+
+	fmt.Println(time.Now(), "Work is beginning.")
+	var ServStruck = libr.NewSkzWithCache(libr.Connector{Uname: "postgres", Pass: "postgres", Host: "localhost", Port: "5432", Dbname: "postgres"}, CacheOpts, *CacheShards)
+	ServStruck.RefreshRecent = *RefreshRecent
+	ServStruck.Warm = Warm
+	ServStruck.Stream = Stream
 	// Строка для подключения к бд
 	StringOfConnectionToDataBase := ServStruck.Con.GetPGSQL()
 
@@ -27,54 +80,149 @@ func main() {
 		err = nil
 	}
 	fmt.Println(time.Now(), "Connected to Database. Success")
-	//Подтягиваем из бд данные в кэш
+	ServStruck.Repo = libr.NewPgRepository(ServStruck.Pool)
+
+	// Подкоманда migrate: работаем только со схемой и выходим
+	if flag.Arg(0) == "migrate" {
+		err = runMigrate(ServStruck.Pool, flag.Args()[1:])
+		if err != nil {
+			fmt.Println(time.Now(), "Migration failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// Со схемой новее, чем знает сборка, работать нельзя, поэтому здесь выходим
+	if *AutoMigrate {
+		err = libr.MigrateUp(context.TODO(), ServStruck.Pool)
+	} else {
+		err = libr.CheckSchema(context.TODO(), ServStruck.Pool)
+	}
+	if err != nil {
+		fmt.Println(time.Now(), "Database schema is not usable:", err)
+		os.Exit(1)
+	}
 
-	err = ServStruck.InitSomeCache()
+	//Подтягиваем данные в кэш из снимка, а если он не подходит, то из бд
+	err = ServStruck.WarmCache(*SnapshotFile, *SnapshotMaxAge)
 	if err != nil {
 		fmt.Println(time.Now(), "caching data going wrong:", err)
 	}
+	SnapshotCtx, StopSnapshots := context.WithCancel(context.Background())
+	if *SnapshotFile != "" && *SnapshotInterval > 0 {
+		go ServStruck.RunSnapshots(SnapshotCtx, *SnapshotFile, *SnapshotInterval)
+	}
 
 	// Подключаемся к серверу сообщений
-	ServStruck.StreamConn, err = stan.Connect("test-cluster", "client-123", stan.NatsURL("0.0.0.0:4222"))
+	ServStruck.StreamConn, err = stan.Connect(Stream.ClusterID, Stream.ClientID, stan.NatsURL(Stream.URL))
 	if err != nil {
 		fmt.Println("Can't connect to cluster", err)
 		err = nil
 	}
 	fmt.Println(time.Now(), "Connected to cluster. Success")
-	// Подписка на канал, в который передано дефолтное название и метод для обработки сообщений.
-	ServStruck.StreamSubscribe, err = ServStruck.StreamConn.Subscribe("foo", ServStruck.MesageHandler)
+	// Durable подписка на канал с ручным подтверждением, сообщения подтверждаются в MesageHandler.
+	ServStruck.StreamSubscribe, err = ServStruck.StreamConn.Subscribe(Stream.Subject, ServStruck.MesageHandler, Stream.SubscriptionOptions()...)
 	if err != nil {
 		fmt.Println("Can't subscribe to chanel:", err)
 		err = nil
 	}
 	fmt.Println(time.Now(), "Subscribe is done. Succsess")
+	// Сброс кэша от других копий сервиса приходит через обычный NATS того же подключения
+	if Stream.InvalidationSubject != "" {
+		_, err = ServStruck.SubscribeInvalidations()
+		if err != nil {
+			fmt.Println(time.Now(), "Can't subscribe to invalidations:", err)
+			err = nil
+		}
+	}
 	//handlefunc передаем наш метод из структуры для работы с БД и Кэшем
 	http.HandleFunc("/", ServStruck.OrderHandler)
-	err = http.ListenAndServe(":3000", nil)
+	http.HandleFunc("/rejected", ServStruck.RejectedHandler)
+	http.HandleFunc("/orders/", ServStruck.OrdersHandler)
+	http.HandleFunc("/admin/cache", ServStruck.CacheAdminHandler)
+	http.HandleFunc("/api/v1/orders", ServStruck.APIHandler)
+	http.HandleFunc("/api/v1/orders/", ServStruck.APIHandler)
+	http.HandleFunc("/api/v1/lookup", ServStruck.LookupHandler)
+	// Обработчик сигналов регистрируем до запуска сервера, сервер работает в своей рутине
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	Server := &http.Server{Addr: ":3000"}
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		fmt.Println(time.Now(), "Listening on port: 3000")
+		err := Server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println(time.Now(), "\"http.ListenAndServe\" have some err to you", err)
+		}
+	}()
+
+	// Ждем сигнала или падения сервера, потом закрываем все по порядку
+	select {
+	case <-signalChan:
+		fmt.Println(time.Now(), "Received an interrupt, closing subscription and connection...")
+	case <-serverDone:
+	}
+	ShutdownCtx, CancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer CancelShutdown()
+	err = Server.Shutdown(ShutdownCtx)
 	if err != nil {
-		fmt.Println(time.Now(), "\"http.ListenAndServe\" have some err to you", err)
+		fmt.Println(time.Now(), "Stopping http server going wrong:", err)
+	}
+	// Close, а не Unsubscribe: durable подписка сохраняет позицию до следующего запуска
+	if ServStruck.StreamSubscribe != nil {
+		err = ServStruck.StreamSubscribe.Close()
+		if err != nil {
+			fmt.Println(time.Now(), "trouble in closing subscription:", err)
+		}
 	}
-	fmt.Println(time.Now(), "Listening on port: 3000")
+	if ServStruck.StreamConn != nil {
+		err = ServStruck.StreamConn.Close()
+		if err != nil {
+			fmt.Println(time.Now(), "Closing connection with stream server going wrong", err)
+		}
+	}
+	// Последний снимок перед выходом, чтобы следующий запуск начался с полным кэшем
+	StopSnapshots()
+	if *SnapshotFile != "" {
+		err = ServStruck.SaveSnapshot(*SnapshotFile)
+		if err != nil {
+			fmt.Println(time.Now(), "Saving cache snapshot failed:", err)
+		}
+	}
+	ServStruck.Cash.Close()
+	ServStruck.Pool.Close()
+	fmt.Println(time.Now(), "Exiting, glhf")
+}
 
-	// Закрывашка взята из примеров Stan
-	signalChan := make(chan os.Signal, 1)
-	cleanupDone := make(chan bool)
-	signal.Notify(signalChan, os.Interrupt)
-	go func() {
-		for range signalChan {
-			fmt.Println(time.Now(), "Received an interrupt, unsubscribing and closing connection...")
-			err := ServStruck.StreamSubscribe.Unsubscribe()
-			if err != nil {
-				fmt.Println(time.Now(), "trouble in unsubscribing:", err)
-			}
-			err = ServStruck.StreamConn.Close()
+/*
+runMigrate выполняет подкоманду migrate:
+migrate up накатывает все миграции, migrate down [n] откатывает n последних (по умолчанию одну),
+migrate version печатает текущую версию схемы.
+*/
+func runMigrate(Pool *pgxpool.Pool, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [n] | version")
+	}
+	switch args[0] {
+	case "up":
+		return libr.MigrateUp(context.TODO(), Pool)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
 			if err != nil {
-				fmt.Println(time.Now(), "Closing connection with stream server going wrong", err)
+				return fmt.Errorf("bad number of steps: %w", err)
 			}
-			ServStruck.Pool.Close()
-			cleanupDone <- true
 		}
-	}()
-	<-cleanupDone
-	fmt.Println(time.Now(), "Exiting, glhf")
+		return libr.MigrateDown(context.TODO(), Pool, steps)
+	case "version":
+		version, err := libr.SchemaVersion(context.TODO(), Pool)
+		if err != nil {
+			return err
+		}
+		fmt.Println(time.Now(), "Schema version:", version)
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q, usage: migrate up | down [n] | version", args[0])
 }
@@ -0,0 +1,249 @@
+package libr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Размер страницы в GET /api/v1/orders: по умолчанию и наибольший.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// CacheOriginHeader заголовок ответа API, откуда взят заказ: cache или database.
+const CacheOriginHeader = "X-Cache-Origin"
+
+// APIError тело ответа API с ошибкой, Fields заполняется для ошибок проверки.
+type APIError struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// writeJSON отдает value в JSON с кодом status.
+func writeJSON(Writer http.ResponseWriter, status int, value interface{}) {
+	Writer.Header().Set("Content-Type", "application/json")
+	Writer.WriteHeader(status)
+	err := json.NewEncoder(Writer).Encode(value)
+	if err != nil {
+		fmt.Println(time.Now(), "Encoding API response failed:", err)
+	}
+}
+
+// writeAPIError отдает ошибку в JSON с кодом status.
+func writeAPIError(Writer http.ResponseWriter, status int, err error) {
+	resp := APIError{Error: err.Error()}
+	var ve ValidationErrors
+	if errors.As(err, &ve) {
+		resp.Fields = ve
+	}
+	writeJSON(Writer, status, resp)
+}
+
+/*
+OrderPage страница списка заказов, NextCursor пустой на последней странице.
+Partial выставляется, когда заказы найдены в кэше: незакэшированные заказы с тем же значением в ответ не попали.
+*/
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	Partial    bool    `json:"partial,omitempty"`
+}
+
+// EncodeCursor превращает позицию в выборке в строку для параметра cursor.
+func EncodeCursor(c OrderCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor разбирает строку из параметра cursor.
+func DecodeCursor(s string) (*OrderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad cursor: %w", err)
+	}
+	var c OrderCursor
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.OrderUID == "" {
+		return nil, errors.New("bad cursor")
+	}
+	return &c, nil
+}
+
+/*
+APIHandler обработчик Http запросов к /api/v1/orders.
+GET /api/v1/orders/{uid} отдает заказ в JSON: 400 для неверного номера, 404 если заказа нет,
+500 при ошибке БД. Заголовок X-Cache-Origin показывает, взят заказ из кэша или из БД.
+GET /api/v1/orders отдает страницу списка заказов (см. listOrders).
+*/
+func (o *Skz) APIHandler(Writer http.ResponseWriter, Request *http.Request) {
+	if Request.Method != "GET" {
+		writeAPIError(Writer, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	uid := strings.Trim(strings.TrimPrefix(Request.URL.Path, "/api/v1/orders"), "/")
+	if uid == "" {
+		o.listOrders(Writer, Request)
+		return
+	}
+	if strings.Contains(uid, "/") {
+		writeAPIError(Writer, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	o.getOrder(Writer, uid)
+}
+
+// getOrder обрабатывает GET /api/v1/orders/{uid}.
+func (o *Skz) getOrder(Writer http.ResponseWriter, uid string) {
+	err := ValidateOrderUID(uid)
+	if err != nil {
+		writeAPIError(Writer, http.StatusBadRequest, err)
+		return
+	}
+	ord, cached, err := o.Cash.GetOrLoad(uid, orderTTL, o.loadOrder)
+	if errors.Is(err, ErrOrderNotFound) {
+		writeAPIError(Writer, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		fmt.Println(time.Now(), "Reading order", uid, "failed:", err)
+		writeAPIError(Writer, http.StatusInternalServerError, errors.New("reading order failed"))
+		return
+	}
+	if cached {
+		Writer.Header().Set(CacheOriginHeader, "cache")
+	} else {
+		Writer.Header().Set(CacheOriginHeader, "database")
+	}
+	writeJSON(Writer, http.StatusOK, ord)
+}
+
+/*
+listOrders обрабатывает GET /api/v1/orders. Фильтры: customer_id, track_number, delivery_service, locale,
+currency, provider, transaction, rid, created_from и created_to (RFC 3339, created_to не включается).
+limit размер страницы (по умолчанию 50, не больше 500), cursor берется из next_cursor предыдущей страницы.
+*/
+func (o *Skz) listOrders(Writer http.ResponseWriter, Request *http.Request) {
+	q := Request.URL.Query()
+	filter := OrderFilter{
+		CustomerID:      q.Get("customer_id"),
+		TrackNumber:     q.Get("track_number"),
+		DeliveryService: q.Get("delivery_service"),
+		Locale:          q.Get("locale"),
+		Currency:        q.Get("currency"),
+		Provider:        q.Get("provider"),
+		Transaction:     q.Get("transaction"),
+		Rid:             q.Get("rid"),
+		Limit:           defaultPageSize,
+	}
+	var err error
+	if v := q.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxPageSize {
+			writeAPIError(Writer, http.StatusBadRequest, fmt.Errorf("limit must be from 1 to %d", maxPageSize))
+			return
+		}
+	}
+	for name, t := range map[string]*time.Time{"created_from": &filter.CreatedFrom, "created_to": &filter.CreatedTo} {
+		if v := q.Get(name); v != "" {
+			*t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(Writer, http.StatusBadRequest, fmt.Errorf("bad %s: %w", name, err))
+				return
+			}
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		filter.After, err = DecodeCursor(v)
+		if err != nil {
+			writeAPIError(Writer, http.StatusBadRequest, err)
+			return
+		}
+	}
+	// Берем на один заказ больше, чтобы понять, есть ли следующая страница
+	pageSize := filter.Limit
+	filter.Limit++
+	orders, err := o.Repo.List(Request.Context(), filter)
+	if err != nil {
+		fmt.Println(time.Now(), "Listing orders failed:", err)
+		writeAPIError(Writer, http.StatusInternalServerError, errors.New("listing orders failed"))
+		return
+	}
+	page := OrderPage{Orders: orders}
+	if len(orders) > pageSize {
+		page.Orders = orders[:pageSize]
+		last := page.Orders[pageSize-1]
+		page.NextCursor = EncodeCursor(OrderCursor{DateCreated: last.DateCreated, OrderUID: last.OrderUID})
+	}
+	writeJSON(Writer, http.StatusOK, page)
+}
+
+/*
+LookupHandler обработчик GET /api/v1/lookup: поиск заказов по одному из параметров
+track_number, customer_id, transaction или rid, заказы идут от новых к старым, как в GET /api/v1/orders.
+Сначала ищем во вторичных индексах кэша. Любому значению может соответствовать несколько заказов,
+и не все они могут быть в кэше, поэтому такой ответ помечается partial. С параметром complete=true
+или если в кэше ничего нет, поиск идет в БД (не больше 500 заказов), и найденное кладется в кэш.
+*/
+func (o *Skz) LookupHandler(Writer http.ResponseWriter, Request *http.Request) {
+	if Request.Method != "GET" {
+		writeAPIError(Writer, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	q := Request.URL.Query()
+	var index, value string
+	for _, name := range []string{IndexTrackNumber, IndexCustomerID, IndexTransaction, IndexRid} {
+		if v := q.Get(name); v != "" {
+			if index != "" {
+				writeAPIError(Writer, http.StatusBadRequest, errors.New("only one of track_number, customer_id, transaction, rid is allowed"))
+				return
+			}
+			index, value = name, v
+		}
+	}
+	if index == "" {
+		writeAPIError(Writer, http.StatusBadRequest, errors.New("one of track_number, customer_id, transaction, rid is required"))
+		return
+	}
+	if q.Get("complete") != "true" {
+		orders := o.Cash.Lookup(index, value)
+		if len(orders) > 0 {
+			sortNewestFirst(orders)
+			Writer.Header().Set(CacheOriginHeader, "cache")
+			writeJSON(Writer, http.StatusOK, OrderPage{Orders: orders, Partial: true})
+			return
+		}
+	}
+	filter := OrderFilter{Limit: maxPageSize}
+	switch index {
+	case IndexTrackNumber:
+		filter.TrackNumber = value
+	case IndexCustomerID:
+		filter.CustomerID = value
+	case IndexTransaction:
+		filter.Transaction = value
+	case IndexRid:
+		filter.Rid = value
+	}
+	orders, err := o.Repo.List(Request.Context(), filter)
+	if err != nil {
+		fmt.Println(time.Now(), "Looking up orders by", index, "failed:", err)
+		writeAPIError(Writer, http.StatusInternalServerError, errors.New("looking up orders failed"))
+		return
+	}
+	if len(orders) == 0 {
+		writeAPIError(Writer, http.StatusNotFound, ErrOrderNotFound)
+		return
+	}
+	for _, ord := range orders {
+		o.Cash.Set(ord.OrderUID, ord, orderTTL)
+	}
+	Writer.Header().Set(CacheOriginHeader, "database")
+	writeJSON(Writer, http.StatusOK, OrderPage{Orders: orders})
+}
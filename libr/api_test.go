@@ -0,0 +1,120 @@
+package libr
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listPage запрашивает GET /api/v1/orders с параметрами query и разбирает страницу, если ответ 200.
+func listPage(t *testing.T, o *Skz, query url.Values) (int, OrderPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	o.APIHandler(w, httptest.NewRequest("GET", "/api/v1/orders?"+query.Encode(), nil))
+	var page OrderPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, page
+}
+
+// saveOrders сохраняет n заказов, у первых ties из них одинаковое DateCreated.
+func saveOrders(t *testing.T, repo *MemoryRepository, n, ties int) []Order {
+	t.Helper()
+	base := time.Now().UTC().Truncate(time.Second)
+	list := make([]Order, n)
+	for i := range list {
+		list[i] = *NewStrGen()
+		list[i].DateCreated = base
+		if i >= ties {
+			list[i].DateCreated = base.Add(-time.Duration(i) * time.Minute)
+		}
+		if err := repo.Save(context.TODO(), list[i], uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sortNewestFirst(list)
+	return list
+}
+
+func TestListOrdersCursor(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	want := saveOrders(t, repo, 9, 4)
+	got := make([]string, 0, len(want))
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("cursor does not advance")
+		}
+		code, page := listPage(t, o, query)
+		if code != http.StatusOK {
+			t.Fatalf("page %d: status %d", pages, code)
+		}
+		if len(page.Orders) > 2 {
+			t.Fatalf("page %d has %d orders, limit is 2", pages, len(page.Orders))
+		}
+		for _, ord := range page.Orders {
+			got = append(got, ord.OrderUID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+	// Заказы с одинаковой датой не теряются и не повторяются на границе страниц
+	if len(got) != len(want) {
+		t.Fatalf("got %d orders over all pages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i].OrderUID {
+			t.Fatalf("order %d is %s, want %s", i, got[i], want[i].OrderUID)
+		}
+	}
+}
+
+func TestListOrdersParams(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	all := saveOrders(t, repo, defaultPageSize+5, 0)
+	badCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"date_created": "2022-01-01T00:00:00Z"}`))
+	for _, c := range []struct {
+		name   string
+		query  url.Values
+		status int
+		orders int
+		next   bool
+	}{
+		{"default limit", url.Values{}, http.StatusOK, defaultPageSize, true},
+		{"max limit", url.Values{"limit": {"500"}}, http.StatusOK, len(all), false},
+		{"zero limit", url.Values{"limit": {"0"}}, http.StatusBadRequest, 0, false},
+		{"negative limit", url.Values{"limit": {"-1"}}, http.StatusBadRequest, 0, false},
+		{"limit over max", url.Values{"limit": {"501"}}, http.StatusBadRequest, 0, false},
+		{"limit not a number", url.Values{"limit": {"ten"}}, http.StatusBadRequest, 0, false},
+		{"cursor not base64", url.Values{"cursor": {"!!"}}, http.StatusBadRequest, 0, false},
+		{"cursor without uid", url.Values{"cursor": {badCursor}}, http.StatusBadRequest, 0, false},
+		{"bad created_from", url.Values{"created_from": {"yesterday"}}, http.StatusBadRequest, 0, false},
+		{"bad created_to", url.Values{"created_to": {"2022-13-01"}}, http.StatusBadRequest, 0, false},
+		{"created range", url.Values{
+			"created_from": {all[5].DateCreated.Format(time.RFC3339)},
+			"created_to":   {all[1].DateCreated.Format(time.RFC3339)},
+		}, http.StatusOK, 4, false},
+		{"locale", url.Values{"locale": {"ru"}}, http.StatusOK, 0, false},
+	} {
+		code, page := listPage(t, o, c.query)
+		if code != c.status || len(page.Orders) != c.orders || (page.NextCursor != "") != c.next {
+			t.Errorf("%s: got %d with %d orders, next %q; want %d with %d orders", c.name, code, len(page.Orders), page.NextCursor, c.status, c.orders)
+		}
+	}
+	// Путь со слэшем и без номера тоже отдает список, а не 400
+	w := httptest.NewRecorder()
+	o.APIHandler(w, httptest.NewRequest("GET", "/api/v1/orders/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/api/v1/orders/: status %d", w.Code)
+	}
+}
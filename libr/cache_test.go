@@ -0,0 +1,76 @@
+package libr
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitGoroutines ждет, пока число рутин опустится до want: остановленные рутины завершаются не мгновенно.
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, want %d:\n%s", runtime.NumGoroutine(), want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseStopsGC(t *testing.T) {
+	base := runtime.NumGoroutine()
+	caches := make([]*Cache[string, int], 50)
+	for i := range caches {
+		caches[i] = NewCatch[string, int](time.Minute, time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n < base+len(caches) {
+		t.Fatalf("got %d goroutines, want at least %d with running collectors", n, base+len(caches))
+	}
+	for _, c := range caches {
+		c.Close()
+		// Повторный Close ничего не делает и не блокируется
+		c.Close()
+	}
+	waitGoroutines(t, base)
+}
+
+func TestStartGCContextCancel(t *testing.T) {
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	caches := make([]*Cache[string, int], 20)
+	for i := range caches {
+		caches[i] = NewCatch[string, int](time.Minute, 0)
+		caches[i].cleanupInterval = time.Millisecond
+		caches[i].StartGCContext(ctx)
+		// Второй запуск не создает еще одну рутину
+		caches[i].StartGCContext(ctx)
+	}
+	if n := runtime.NumGoroutine(); n < base+len(caches) {
+		t.Fatalf("got %d goroutines, want at least %d with running collectors", n, base+len(caches))
+	}
+	cancel()
+	waitGoroutines(t, base)
+	// Close после отмены контекста не должен зависнуть
+	for _, c := range caches {
+		c.Close()
+	}
+}
+
+func TestGCRemovesExpired(t *testing.T) {
+	c := NewCatch[string, int](time.Millisecond, time.Millisecond)
+	defer c.Close()
+	c.Set("a", 1, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired entry was not collected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := c.Stats(); st.Expirations != 1 {
+		t.Fatalf("got %d expirations, want 1", st.Expirations)
+	}
+}
@@ -0,0 +1,113 @@
+package libr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+CacheStats статистика кэша. Expirations считает записи, убранные сборщиком мусора по времени,
+Evictions записи, вытесненные из-за лимитов. OldestAge возраст самой старой записи.
+*/
+type CacheStats struct {
+	Hits        uint64        `json:"hits"`
+	Misses      uint64        `json:"misses"`
+	HitRatio    float64       `json:"hit_ratio"`
+	Evictions   uint64        `json:"evictions"`
+	Expirations uint64        `json:"expirations"`
+	Entries     int           `json:"entries"`
+	Bytes       int64         `json:"bytes"`
+	OldestAge   time.Duration `json:"oldest_age_ns"`
+}
+
+// CacheKeyInfo ключ кэша со временем записи и временем истечения (nil для бессрочных).
+type CacheKeyInfo[K comparable] struct {
+	Key        K          `json:"key"`
+	Created    time.Time  `json:"created"`
+	Expiration *time.Time `json:"expiration"`
+}
+
+// Stats возвращает текущую статистику кэша.
+func (c *Cache[K, V]) Stats() CacheStats {
+	st := CacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	st.Entries = len(c.items)
+	st.Bytes = c.bytes
+	var oldest time.Time
+	for _, item := range c.items {
+		if oldest.IsZero() || item.Created.Before(oldest) {
+			oldest = item.Created
+		}
+	}
+	if !oldest.IsZero() {
+		st.OldestAge = time.Since(oldest)
+	}
+	return st
+}
+
+// Keys возвращает ключи кэша от старых записей к новым, limit <= 0 значит все.
+func (c *Cache[K, V]) Keys(limit int) []CacheKeyInfo[K] {
+	c.RLock()
+	keys := make([]CacheKeyInfo[K], 0, len(c.items))
+	for k, item := range c.items {
+		info := CacheKeyInfo[K]{Key: k, Created: item.Created}
+		if item.Expiration > 0 {
+			exp := time.Unix(0, item.Expiration)
+			info.Expiration = &exp
+		}
+		keys = append(keys, info)
+	}
+	c.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+/*
+CacheAdminHandler отдает в JSON статистику кэша заказов и список ключей.
+Параметр limit ограничивает число ключей (по умолчанию 1000, 0 все), keys=false убирает список.
+*/
+func (o *Skz) CacheAdminHandler(Writer http.ResponseWriter, Request *http.Request) {
+	if Request.Method != "GET" {
+		http.Error(Writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 1000
+	if l := Request.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			http.Error(Writer, "bad limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var resp struct {
+		Stats CacheStats             `json:"stats"`
+		Keys  []CacheKeyInfo[string] `json:"keys,omitempty"`
+	}
+	resp.Stats = o.Cash.Stats()
+	if Request.URL.Query().Get("keys") != "false" {
+		resp.Keys = o.Cash.Keys(limit)
+	}
+	Writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(Writer).Encode(resp)
+	if err != nil {
+		fmt.Println(time.Now(), "Encoding cache stats failed:", err)
+	}
+}
@@ -0,0 +1,335 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	stan "github.com/nats-io/stan.go"
+)
+
+/*
+RejectedMessage сообщение из канала, которое не удалось разобрать или которое не прошло проверку.
+Хранит исходные байты, причину отказа, номер сообщения в канале и время отказа.
+Data в JSON передается в base64, чтобы байты, которые не являются UTF-8, дошли без изменений.
+ResubmittedData исправленный вариант, если сообщение отправляли повторно с исправлениями, Data при этом не меняется.
+*/
+type RejectedMessage struct {
+	ID              int64     `json:"id"`
+	Subject         string    `json:"subject"`
+	Kind            string    `json:"kind"`
+	Data            []byte    `json:"data"`
+	Reason          string    `json:"reason"`
+	Sequence        uint64    `json:"sequence"`
+	Timestamp       time.Time `json:"timestamp"`
+	Resubmitted     bool      `json:"resubmitted"`
+	ResubmittedData []byte    `json:"resubmitted_data,omitempty"`
+}
+
+// Виды отклоненных сообщений.
+const (
+	// RejectUnparseable сообщение не разбирается как JSON.
+	RejectUnparseable = "unparseable"
+	// RejectInvalid заказ не прошел проверку.
+	RejectInvalid = "invalid"
+	// RejectConflict заказ с таким номером уже сохранен с другим содержимым, нужен ручной разбор.
+	RejectConflict = "conflict"
+	// RejectStale обновление с версией не новее сохраненной.
+	RejectStale = "stale"
+	// RejectRedelivered заказ не удалось записать за MaxRedeliveries доставок.
+	RejectRedelivered = "redelivered"
+)
+
+// rejectKind определяет вид отказа по ошибке.
+func rejectKind(reason error) string {
+	var ve ValidationErrors
+	switch {
+	case errors.Is(reason, ErrOrderConflict):
+		return RejectConflict
+	case errors.Is(reason, ErrStaleVersion):
+		return RejectStale
+	case errors.Is(reason, ErrTooManyRedeliveries):
+		return RejectRedelivered
+	case errors.As(reason, &ve):
+		return RejectInvalid
+	}
+	return RejectUnparseable
+}
+
+// ErrRejectedNotFound отклоненного сообщения с таким номером нет.
+var ErrRejectedNotFound = errors.New("rejected message not found")
+
+/*
+RejectedStore хранилище отклоненных сообщений. Его реализуют PgRepository (таблица rejected_messages)
+и MemoryRepository, Skz работает с ним через OrderRepository.
+*/
+type RejectedStore interface {
+	// SaveRejected сохраняет сообщение и записывает в rm.ID присвоенный номер.
+	SaveRejected(ctx context.Context, rm *RejectedMessage) error
+	// ListRejected возвращает сообщения по порядку номеров, all добавляет уже отправленные повторно, непустой kind выбирает вид.
+	ListRejected(ctx context.Context, all bool, kind string) ([]RejectedMessage, error)
+	// GetRejected возвращает сообщение по номеру или ErrRejectedNotFound.
+	GetRejected(ctx context.Context, id int64) (RejectedMessage, error)
+	/*
+		MarkResubmitted отмечает сообщение отправленным повторно и запоминает исправленный вариант corrected
+		(nil, если отправлены исходные байты), исходные байты не меняются. Для неизвестного id возвращает ErrRejectedNotFound.
+	*/
+	MarkResubmitted(ctx context.Context, id int64, corrected []byte) error
+}
+
+/*
+RejectMessage отправляет сообщение в dead-letter канал и сохраняет его в хранилище отклоненных сообщений.
+Если сохранить не удалось, возвращается ошибка и сообщение подтверждать нельзя.
+*/
+func (o *Skz) RejectMessage(ctx context.Context, m *stan.Msg, reason error) error {
+	rm := RejectedMessage{
+		Subject:   m.Subject,
+		Kind:      rejectKind(reason),
+		Data:      m.Data,
+		Reason:    reason.Error(),
+		Sequence:  m.Sequence,
+		Timestamp: time.Now(),
+	}
+	err := o.Repo.SaveRejected(ctx, &rm)
+	if err != nil {
+		return err
+	}
+	fmt.Println(time.Now(), "Message", m.Sequence, "rejected as", rm.Kind, "with id", rm.ID, "reason:", rm.Reason)
+	if o.Stream.DeadLetterSubject == "" || o.StreamConn == nil {
+		return nil
+	}
+	JsonRejected, err := json.Marshal(rm)
+	if err != nil {
+		return fmt.Errorf("marshal rejected message: %w", err)
+	}
+	err = o.StreamConn.Publish(o.Stream.DeadLetterSubject, JsonRejected)
+	if err != nil {
+		// Сообщение уже сохранено, поэтому канал dead-letter не критичен
+		fmt.Println(time.Now(), "Publish to dead-letter subject failed:", err)
+	}
+	return nil
+}
+
+/*
+ResubmitRejected отправляет отклоненное сообщение в основной канал еще раз.
+Если передан data, то вместо исходных байтов отправляется исправленный вариант, а исходные остаются в хранилище.
+*/
+func (o *Skz) ResubmitRejected(ctx context.Context, id int64, data []byte) error {
+	rm, err := o.Repo.GetRejected(ctx, id)
+	if err != nil {
+		return err
+	}
+	payload := rm.Data
+	var corrected []byte
+	if len(data) != 0 {
+		payload, corrected = data, data
+	}
+	err = o.StreamConn.Publish(o.Stream.Subject, payload)
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", o.Stream.Subject, err)
+	}
+	err = o.Repo.MarkResubmitted(ctx, id, corrected)
+	if err != nil {
+		return err
+	}
+	fmt.Println(time.Now(), "Rejected message", id, "resubmitted to", o.Stream.Subject)
+	return nil
+}
+
+// SaveRejected сохраняет отклоненное сообщение в таблицу rejected_messages.
+func (r *PgRepository) SaveRejected(ctx context.Context, rm *RejectedMessage) error {
+	query := "INSERT INTO rejected_messages (subject, kind, data, reason, sequence, rejected_at) Values ($1, $2, $3, $4, $5, $6) returning id"
+	err := r.Pool.QueryRow(ctx, query, rm.Subject, rm.Kind, rm.Data, rm.Reason, int64(rm.Sequence), rm.Timestamp).Scan(&rm.ID)
+	if err != nil {
+		return fmt.Errorf("insert to rejected_messages: %w", err)
+	}
+	return nil
+}
+
+// ListRejected выбирает отклоненные сообщения из rejected_messages.
+func (r *PgRepository) ListRejected(ctx context.Context, all bool, kind string) ([]RejectedMessage, error) {
+	query := `select id, subject, kind, data, reason, sequence, rejected_at, resubmitted, resubmitted_data 
+		from rejected_messages 
+		where ($1 or not resubmitted) and ($2 = '' or kind = $2) 
+		order by id`
+	rows, err := r.Pool.Query(ctx, query, all, kind)
+	if err != nil {
+		return nil, fmt.Errorf("select from rejected_messages: %w", err)
+	}
+	defer rows.Close()
+	list := make([]RejectedMessage, 0)
+	for rows.Next() {
+		rm, err := scanRejected(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rm)
+	}
+	return list, rows.Err()
+}
+
+// GetRejected выбирает отклоненное сообщение по номеру.
+func (r *PgRepository) GetRejected(ctx context.Context, id int64) (RejectedMessage, error) {
+	rm, err := scanRejected(r.Pool.QueryRow(ctx, `select id, subject, kind, data, reason, sequence, rejected_at, resubmitted, resubmitted_data 
+		from rejected_messages where id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return RejectedMessage{}, ErrRejectedNotFound
+	}
+	return rm, err
+}
+
+// scanRejected читает строку rejected_messages.
+func scanRejected(row pgx.Row) (RejectedMessage, error) {
+	var rm RejectedMessage
+	var seq int64
+	err := row.Scan(&rm.ID, &rm.Subject, &rm.Kind, &rm.Data, &rm.Reason, &seq, &rm.Timestamp, &rm.Resubmitted, &rm.ResubmittedData)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rm, err
+	}
+	if err != nil {
+		return rm, fmt.Errorf("scanning rejected message: %w", err)
+	}
+	rm.Sequence = uint64(seq)
+	return rm, nil
+}
+
+// MarkResubmitted отмечает сообщение в rejected_messages отправленным повторно.
+func (r *PgRepository) MarkResubmitted(ctx context.Context, id int64, corrected []byte) error {
+	tag, err := r.Pool.Exec(ctx, "update rejected_messages set resubmitted = true, resubmitted_data = $2 where id = $1", id, corrected)
+	if err != nil {
+		return fmt.Errorf("update rejected message %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRejectedNotFound
+	}
+	return nil
+}
+
+// SaveRejected сохраняет копию отклоненного сообщения в памяти.
+func (r *MemoryRepository) SaveRejected(ctx context.Context, rm *RejectedMessage) error {
+	r.Lock()
+	defer r.Unlock()
+	rm.ID = int64(len(r.rejected) + 1)
+	r.rejected = append(r.rejected, copyRejected(*rm))
+	return nil
+}
+
+// ListRejected возвращает копии отклоненных сообщений из памяти.
+func (r *MemoryRepository) ListRejected(ctx context.Context, all bool, kind string) ([]RejectedMessage, error) {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]RejectedMessage, 0)
+	for _, rm := range r.rejected {
+		if (all || !rm.Resubmitted) && (kind == "" || rm.Kind == kind) {
+			list = append(list, copyRejected(rm))
+		}
+	}
+	return list, nil
+}
+
+// GetRejected возвращает копию отклоненного сообщения из памяти.
+func (r *MemoryRepository) GetRejected(ctx context.Context, id int64) (RejectedMessage, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if id < 1 || id > int64(len(r.rejected)) {
+		return RejectedMessage{}, ErrRejectedNotFound
+	}
+	return copyRejected(r.rejected[id-1]), nil
+}
+
+// MarkResubmitted отмечает отклоненное сообщение в памяти отправленным повторно.
+func (r *MemoryRepository) MarkResubmitted(ctx context.Context, id int64, corrected []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	if id < 1 || id > int64(len(r.rejected)) {
+		return ErrRejectedNotFound
+	}
+	r.rejected[id-1].Resubmitted = true
+	if corrected != nil {
+		r.rejected[id-1].ResubmittedData = append([]byte(nil), corrected...)
+	}
+	return nil
+}
+
+// copyRejected копирует отклоненное сообщение вместе с его байтами.
+func copyRejected(rm RejectedMessage) RejectedMessage {
+	rm.Data = append([]byte(nil), rm.Data...)
+	if rm.ResubmittedData != nil {
+		rm.ResubmittedData = append([]byte(nil), rm.ResubmittedData...)
+	}
+	return rm
+}
+
+/*
+RejectedHandler обработчик Http запросов к отклоненным сообщениям.
+GET отдает список в JSON (параметр all=true добавляет уже отправленные повторно, kind выбирает вид отказа),
+POST с полями id и data (необязательно, исправленный заказ или событие) отправляет сообщение в канал еще раз.
+*/
+func (o *Skz) RejectedHandler(Writer http.ResponseWriter, Request *http.Request) {
+	switch Request.Method {
+	case "GET":
+		list, err := o.Repo.ListRejected(Request.Context(), Request.URL.Query().Get("all") == "true", Request.URL.Query().Get("kind"))
+		if err != nil {
+			http.Error(Writer, err.Error(), http.StatusInternalServerError)
+			fmt.Println(time.Now(), "Listing rejected messages failed:", err)
+			return
+		}
+		Writer.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(Writer).Encode(list)
+		if err != nil {
+			fmt.Println(time.Now(), "Encoding rejected messages failed:", err)
+		}
+	case "POST":
+		id, err := strconv.ParseInt(Request.PostFormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(Writer, "bad id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := []byte(Request.PostFormValue("data"))
+		if len(data) != 0 {
+			// Исправленный заказ проверяем сразу, чтобы не гонять его через канал обратно в rejected
+			var ev OrderEvent
+			ev, err = ParseOrderEvent(data)
+			if err == nil {
+				err = ev.Order.Validate()
+			}
+			if err != nil {
+				writeValidationError(Writer, err)
+				return
+			}
+		}
+		err = o.ResubmitRejected(Request.Context(), id, data)
+		if errors.Is(err, ErrRejectedNotFound) {
+			http.Error(Writer, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(Writer, err.Error(), http.StatusInternalServerError)
+			fmt.Println(time.Now(), "Resubmitting rejected message failed:", err)
+			return
+		}
+		Writer.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(Writer, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeValidationError отвечает 422 со списком ошибок полей, либо 400 если JSON не разобрался.
+func writeValidationError(Writer http.ResponseWriter, err error) {
+	ve, ok := err.(ValidationErrors)
+	if !ok {
+		http.Error(Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	Writer.Header().Set("Content-Type", "application/json")
+	Writer.WriteHeader(http.StatusUnprocessableEntity)
+	err = json.NewEncoder(Writer).Encode(ve)
+	if err != nil {
+		fmt.Println(time.Now(), "Encoding validation errors failed:", err)
+	}
+}
@@ -0,0 +1,130 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// publishRecorder подменяет подключение к стриму и запоминает отправленные сообщения.
+type publishRecorder struct {
+	stan.Conn
+	sync.Mutex
+	published map[string][][]byte
+}
+
+func (p *publishRecorder) Publish(subject string, data []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	p.published[subject] = append(p.published[subject], data)
+	return nil
+}
+
+func (p *publishRecorder) last(subject string) string {
+	p.Lock()
+	defer p.Unlock()
+	list := p.published[subject]
+	if len(list) == 0 {
+		return ""
+	}
+	return string(list[len(list)-1])
+}
+
+func TestMesageHandlerRejects(t *testing.T) {
+	o, _, acks := newTestSkz()
+	ord := *NewStrGen()
+	invalid := *NewStrGen()
+	invalid.OrderUID = ""
+	conflict := ord
+	conflict.Entry = "other"
+	updated := ord
+	updated.Deliveries.Address = "corrected " + ord.Deliveries.Address
+	stale := ord
+	stale.Deliveries.Address = "other " + ord.Deliveries.Address
+
+	o.MesageHandler(fakeMsg(1, mustJSON(t, ord)))
+	o.MesageHandler(fakeMsg(2, mustJSON(t, NewUpdateEvent(updated, 2))))
+	for _, c := range []struct {
+		seq  uint64
+		data []byte
+		kind string
+	}{
+		{3, []byte("{not json"), RejectUnparseable},
+		{4, mustJSON(t, invalid), RejectInvalid},
+		{5, mustJSON(t, conflict), RejectConflict},
+		{6, mustJSON(t, NewUpdateEvent(stale, 2)), RejectStale},
+	} {
+		o.MesageHandler(fakeMsg(c.seq, c.data))
+		if n := acks.count(c.seq); n != 1 {
+			t.Errorf("%s message acked %d times, want 1", c.kind, n)
+		}
+		w := httptest.NewRecorder()
+		o.RejectedHandler(w, httptest.NewRequest("GET", "/rejected?kind="+c.kind, nil))
+		var list []RejectedMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET /rejected?kind=%s: %d %s", c.kind, w.Code, w.Body.String())
+		}
+		if len(list) != 1 || list[0].Sequence != c.seq || string(list[0].Data) != string(c.data) {
+			t.Errorf("GET /rejected?kind=%s returned %+v", c.kind, list)
+		}
+	}
+}
+
+func TestResubmitRejected(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	conn := &publishRecorder{published: make(map[string][][]byte)}
+	o.StreamConn = conn
+	o.Stream.Subject = "orders"
+	original := []byte("{broken")
+	o.MesageHandler(fakeMsg(1, original))
+	corrected := string(mustJSON(t, NewStrGen()))
+
+	post := func(form url.Values) int {
+		req := httptest.NewRequest("POST", "/rejected", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		o.RejectedHandler(w, req)
+		return w.Code
+	}
+	if code := post(url.Values{"id": {"1"}, "data": {corrected}}); code != http.StatusAccepted {
+		t.Fatalf("resubmit with corrected data: status %d", code)
+	}
+	if got := conn.last("orders"); got != corrected {
+		t.Fatalf("published %q, want corrected order", got)
+	}
+	rm, err := repo.GetRejected(context.TODO(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Исходные байты остаются для разбора, исправление хранится отдельно
+	if string(rm.Data) != string(original) || string(rm.ResubmittedData) != corrected || !rm.Resubmitted {
+		t.Fatalf("after resubmit: data %q, resubmitted data %q, resubmitted %v", rm.Data, rm.ResubmittedData, rm.Resubmitted)
+	}
+
+	if code := post(url.Values{"id": {"1"}}); code != http.StatusAccepted {
+		t.Fatalf("resubmit as is: status %d", code)
+	}
+	if got := conn.last("orders"); got != string(original) {
+		t.Fatalf("published %q, want original bytes", got)
+	}
+	for _, c := range []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"id": {"7"}}, http.StatusNotFound},
+		{url.Values{"id": {"x"}}, http.StatusBadRequest},
+		{url.Values{"id": {"1"}, "data": {"{broken"}}, http.StatusBadRequest},
+		{url.Values{"id": {"1"}, "data": {`{"order_uid": ""}`}}, http.StatusUnprocessableEntity},
+	} {
+		if code := post(c.form); code != c.status {
+			t.Errorf("POST %v: status %d, want %d", c.form, code, c.status)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package libr
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Типы событий в канале заказов.
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+)
+
+/*
+OrderEvent событие в канале заказов. Для обновления Version это новая версия заказа,
+она должна быть ровно на 1 больше сохраненной, иначе обновление отклоняется.
+*/
+type OrderEvent struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	Order   Order  `json:"order"`
+}
+
+// NewUpdateEvent собирает событие обновления заказа до версии version.
+func NewUpdateEvent(ord Order, version int) OrderEvent {
+	ord.Version = version
+	return OrderEvent{Type: EventUpdate, Version: version, Order: ord}
+}
+
+/*
+ParseOrderEvent разбирает сообщение из канала.
+Сообщение без поля type это заказ целиком, как его отправляет publisher, он считается созданием версии 1.
+*/
+func ParseOrderEvent(data []byte) (OrderEvent, error) {
+	var probe struct {
+		Type    string          `json:"type"`
+		Version int             `json:"version"`
+		Order   json.RawMessage `json:"order"`
+	}
+	err := json.Unmarshal(data, &probe)
+	if err != nil {
+		return OrderEvent{}, fmt.Errorf("unmarshal order event: %w", err)
+	}
+	ev := OrderEvent{Type: probe.Type, Version: probe.Version}
+	switch probe.Type {
+	case "":
+		ev.Type = EventCreate
+		err = json.Unmarshal(data, &ev.Order)
+		if err != nil {
+			return OrderEvent{}, fmt.Errorf("unmarshal order: %w", err)
+		}
+		ev.Version = ev.Order.Version
+	case EventCreate, EventUpdate:
+		if len(probe.Order) == 0 {
+			return OrderEvent{}, fmt.Errorf("%s event without order", probe.Type)
+		}
+		err = json.Unmarshal(probe.Order, &ev.Order)
+		if err != nil {
+			return OrderEvent{}, fmt.Errorf("unmarshal order: %w", err)
+		}
+		if ev.Version == 0 {
+			ev.Version = ev.Order.Version
+		}
+	default:
+		return OrderEvent{}, fmt.Errorf("unknown order event type %q", probe.Type)
+	}
+	if ev.Type == EventCreate && ev.Version == 0 {
+		ev.Version = 1
+	}
+	if ev.Type == EventUpdate && ev.Version < 2 {
+		return OrderEvent{}, fmt.Errorf("update event for order %s must have version 2 or greater, got %d", ev.Order.OrderUID, ev.Version)
+	}
+	ev.Order.Version = ev.Version
+	return ev, nil
+}
@@ -0,0 +1,215 @@
+package libr
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math"
+)
+
+/*
+EvictionPolicy решает, какой ключ вытеснить из кэша, когда превышен лимит записей или байт.
+Методы вызываются кэшем под его блокировкой, поэтому политике своя блокировка не нужна.
+*/
+type EvictionPolicy[K comparable] interface {
+	// Added вызывается при записи ключа, expiration время истечения в UnixNano, 0 если бессрочно.
+	Added(key K, expiration int64)
+	// Accessed вызывается при успешном чтении ключа.
+	Accessed(key K)
+	// Removed вызывается, когда ключ удален, устарел или вытеснен.
+	Removed(key K)
+	// Victim возвращает ключ, который нужно вытеснить первым.
+	Victim() (K, bool)
+}
+
+// Названия политик для настроек.
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+	PolicyTTL = "ttl"
+)
+
+// NewEvictionPolicy создает политику по названию: lru, lfu или ttl.
+func NewEvictionPolicy[K comparable](name string) (EvictionPolicy[K], error) {
+	switch name {
+	case PolicyLRU:
+		return NewLRUPolicy[K](), nil
+	case PolicyLFU:
+		return NewLFUPolicy[K](), nil
+	case PolicyTTL:
+		return NewTTLPolicy[K](), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q, expected %s, %s or %s", name, PolicyLRU, PolicyLFU, PolicyTTL)
+}
+
+// LRUPolicy вытесняет ключ, который дольше всех не читали и не записывали.
+type LRUPolicy[K comparable] struct {
+	order    *list.List
+	elements map[K]*list.Element
+}
+
+// NewLRUPolicy создает пустую LRU политику.
+func NewLRUPolicy[K comparable]() *LRUPolicy[K] {
+	return &LRUPolicy[K]{order: list.New(), elements: make(map[K]*list.Element)}
+}
+
+// Added переносит ключ в начало списка.
+func (p *LRUPolicy[K]) Added(key K, expiration int64) {
+	p.Accessed(key)
+}
+
+// Accessed переносит ключ в начало списка.
+func (p *LRUPolicy[K]) Accessed(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+// Removed убирает ключ из списка.
+func (p *LRUPolicy[K]) Removed(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+// Victim возвращает последний ключ списка.
+func (p *LRUPolicy[K]) Victim() (K, bool) {
+	el := p.order.Back()
+	if el == nil {
+		var zero K
+		return zero, false
+	}
+	return el.Value.(K), true
+}
+
+// keyEntry ключ в куче с приоритетом, при равном приоритете раньше идет ключ с меньшим seq.
+type keyEntry[K comparable] struct {
+	key      K
+	priority int64
+	seq      uint64
+	index    int
+}
+
+// keyHeap куча ключей с минимальным приоритетом наверху, реализует heap.Interface.
+type keyHeap[K comparable] []*keyEntry[K]
+
+func (h keyHeap[K]) Len() int { return len(h) }
+
+func (h keyHeap[K]) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h keyHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *keyHeap[K]) Push(x interface{}) {
+	e := x.(*keyEntry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *keyHeap[K]) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// priorityKeys ключи с приоритетом, общая часть LFU и TTL политик.
+type priorityKeys[K comparable] struct {
+	heap    keyHeap[K]
+	entries map[K]*keyEntry[K]
+	seq     uint64
+}
+
+// set выставляет приоритет ключа, добавляя его при необходимости.
+func (pk *priorityKeys[K]) set(key K, priority int64) {
+	pk.seq++
+	if e, ok := pk.entries[key]; ok {
+		e.priority = priority
+		e.seq = pk.seq
+		heap.Fix(&pk.heap, e.index)
+		return
+	}
+	e := &keyEntry[K]{key: key, priority: priority, seq: pk.seq}
+	heap.Push(&pk.heap, e)
+	pk.entries[key] = e
+}
+
+// Removed убирает ключ из кучи.
+func (pk *priorityKeys[K]) Removed(key K) {
+	if e, ok := pk.entries[key]; ok {
+		heap.Remove(&pk.heap, e.index)
+		delete(pk.entries, key)
+	}
+}
+
+// Victim возвращает ключ с минимальным приоритетом.
+func (pk *priorityKeys[K]) Victim() (K, bool) {
+	if len(pk.heap) == 0 {
+		var zero K
+		return zero, false
+	}
+	return pk.heap[0].key, true
+}
+
+/*
+LFUPolicy вытесняет ключ, который читали реже всех.
+Среди одинаково популярных вытесняется тот, к которому дольше не обращались.
+*/
+type LFUPolicy[K comparable] struct {
+	priorityKeys[K]
+}
+
+// NewLFUPolicy создает пустую LFU политику.
+func NewLFUPolicy[K comparable]() *LFUPolicy[K] {
+	return &LFUPolicy[K]{priorityKeys[K]{entries: make(map[K]*keyEntry[K])}}
+}
+
+// Added считает запись ключа обращением к нему.
+func (p *LFUPolicy[K]) Added(key K, expiration int64) {
+	p.Accessed(key)
+}
+
+// Accessed увеличивает счетчик обращений.
+func (p *LFUPolicy[K]) Accessed(key K) {
+	var count int64
+	if e, ok := p.entries[key]; ok {
+		count = e.priority
+	}
+	p.set(key, count+1)
+}
+
+/*
+TTLPolicy вытесняет ключ, время жизни которого закончится раньше всех,
+бессрочные ключи вытесняются последними. Чтение на порядок не влияет.
+*/
+type TTLPolicy[K comparable] struct {
+	priorityKeys[K]
+}
+
+// NewTTLPolicy создает пустую TTL политику.
+func NewTTLPolicy[K comparable]() *TTLPolicy[K] {
+	return &TTLPolicy[K]{priorityKeys[K]{entries: make(map[K]*keyEntry[K])}}
+}
+
+// Added запоминает время истечения ключа.
+func (p *TTLPolicy[K]) Added(key K, expiration int64) {
+	if expiration <= 0 {
+		expiration = math.MaxInt64
+	}
+	p.set(key, expiration)
+}
+
+// Accessed ничего не делает, порядок зависит только от времени истечения.
+func (p *TTLPolicy[K]) Accessed(key K) {}
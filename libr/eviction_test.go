@@ -0,0 +1,182 @@
+package libr
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEvictionKeepsLimit проверяет, что после каждой записи кэш укладывается в лимит и новая запись остается.
+func TestEvictionKeepsLimit(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyLFU, PolicyTTL} {
+		t.Run(name, func(t *testing.T) {
+			policy, err := NewEvictionPolicy[string](name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := NewCacheWithOptions(CacheOptions[string, int]{MaxEntries: 3, Policy: policy})
+			for i := 0; i < 10; i++ {
+				key := strconv.Itoa(i)
+				c.Set(key, i, time.Duration(10-i)*time.Minute)
+				// Старые записи популярнее новой, LFU будет выбирать новую первой
+				for j := 0; j < 3; j++ {
+					c.Get(key)
+				}
+				if c.Len() > 3 {
+					t.Fatalf("after %d sets cache holds %d entries, limit 3", i+1, c.Len())
+				}
+				if _, ok := c.Get(key); !ok {
+					t.Fatalf("just written key %s was evicted", key)
+				}
+			}
+			if st := c.Stats(); st.Evictions != 7 {
+				t.Fatalf("got %d evictions, want 7", st.Evictions)
+			}
+		})
+	}
+}
+
+func TestLFUEvictsLeastUsed(t *testing.T) {
+	c := NewCacheWithOptions(CacheOptions[string, int]{MaxEntries: 2, Policy: NewLFUPolicy[string]()})
+	c.Set("hot", 1, 0)
+	c.Set("cold", 2, 0)
+	c.Get("hot")
+	c.Get("hot")
+	c.Get("cold")
+	c.Set("new", 3, 0)
+	if _, ok := c.Get("cold"); ok {
+		t.Fatal("least used key must be evicted")
+	}
+	for _, key := range []string{"hot", "new"} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("key %s was evicted", key)
+		}
+	}
+}
+
+func TestEvictionByBytes(t *testing.T) {
+	c := NewCacheWithOptions(CacheOptions[string, int]{
+		MaxBytes: 30,
+		Sizer:    func(key string, value int) int64 { return 10 },
+		Policy:   NewLFUPolicy[string](),
+	})
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+		c.Get(strconv.Itoa(0))
+		if st := c.Stats(); st.Bytes > 30 {
+			t.Fatalf("cache holds %d bytes, limit 30", st.Bytes)
+		}
+	}
+}
+
+// hookCall вызов OnEvicted или OnExpired.
+type hookCall struct {
+	hook   string
+	key    string
+	value  int
+	reason EvictionReason
+}
+
+// hookRecorder запоминает вызовы обработчиков.
+type hookRecorder struct {
+	sync.Mutex
+	calls []hookCall
+}
+
+func (h *hookRecorder) hook(name string) func(key string, value int, reason EvictionReason) {
+	return func(key string, value int, reason EvictionReason) {
+		h.Lock()
+		defer h.Unlock()
+		h.calls = append(h.calls, hookCall{name, key, value, reason})
+	}
+}
+
+func (h *hookRecorder) list() []hookCall {
+	h.Lock()
+	defer h.Unlock()
+	return append([]hookCall(nil), h.calls...)
+}
+
+func TestEvictionHooks(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		opts   CacheOptions[string, int]
+		action func(c *Cache[string, int])
+		want   []hookCall
+	}{
+		{"delete", CacheOptions[string, int]{DefaultExpiration: time.Minute}, func(c *Cache[string, int]) {
+			c.Set("a", 1, 0)
+			c.Delete("a")
+		}, []hookCall{{"evicted", "a", 1, EvictionDeleted}}},
+		{"capacity", CacheOptions[string, int]{DefaultExpiration: time.Minute, MaxEntries: 1}, func(c *Cache[string, int]) {
+			c.Set("a", 1, 0)
+			c.Set("b", 2, 0)
+		}, []hookCall{{"evicted", "a", 1, EvictionCapacity}}},
+		{"expired", CacheOptions[string, int]{DefaultExpiration: time.Millisecond}, func(c *Cache[string, int]) {
+			c.Set("a", 1, 0)
+			time.Sleep(5 * time.Millisecond)
+			c.clearItems(c.expiredKeys())
+		}, []hookCall{{"expired", "a", 1, EvictionExpired}, {"evicted", "a", 1, EvictionExpired}}},
+		{"replace is not eviction", CacheOptions[string, int]{DefaultExpiration: time.Minute}, func(c *Cache[string, int]) {
+			c.Set("a", 1, 0)
+			c.Replace("a", 2, 0)
+		}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var h hookRecorder
+			c.opts.OnEvicted = h.hook("evicted")
+			c.opts.OnExpired = h.hook("expired")
+			cache := NewCacheWithOptions(c.opts)
+			c.action(cache)
+			got := h.list()
+			if len(got) != len(c.want) {
+				t.Fatalf("got calls %+v, want %+v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("call %d: got %+v, want %+v", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestEvictionHookReentrant проверяет, что обработчик может обращаться к кэшу, который его вызвал.
+func TestEvictionHookReentrant(t *testing.T) {
+	var cache *Cache[string, int]
+	cache = NewCacheWithOptions(CacheOptions[string, int]{
+		DefaultExpiration: time.Millisecond,
+		MaxEntries:        2,
+		OnEvicted: func(key string, value int, reason EvictionReason) {
+			cache.Get(key)
+			cache.Len()
+			if reason == EvictionDeleted {
+				// Вернуть удаленную запись под другим ключом
+				cache.Set("moved-"+key, value, time.Minute)
+			}
+		},
+	})
+	done := make(chan struct{})
+	var moved int
+	var movedOK bool
+	go func() {
+		defer close(done)
+		cache.Set("a", 1, time.Minute)
+		cache.Delete("a")
+		moved, movedOK = cache.Get("moved-a")
+		for i := 0; i < 5; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+		}
+		time.Sleep(5 * time.Millisecond)
+		cache.clearItems(cache.expiredKeys())
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cache deadlocked in eviction hook")
+	}
+	if !movedOK || moved != 1 {
+		t.Fatalf("entry set from hook: %d, %v", moved, movedOK)
+	}
+}
@@ -0,0 +1,265 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Виды изменений в истории заказа.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	// ChangeDelete заказ удален, снимок хранит его последнюю версию.
+	ChangeDelete = "delete"
+)
+
+// FieldChange изменение одного поля, Field путем как в JSON модели, например "delivery.address".
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+/*
+OrderHistoryEntry запись истории заказа: снимок заказа после изменения,
+номер сообщения в канале, из которого пришло изменение, и отличия от предыдущей версии.
+Для создания заказа список отличий пустой.
+*/
+type OrderHistoryEntry struct {
+	Version   int           `json:"version"`
+	Change    string        `json:"change"`
+	Snapshot  Order         `json:"snapshot"`
+	Diff      []FieldChange `json:"diff"`
+	Sequence  uint64        `json:"sequence"`
+	ChangedAt time.Time     `json:"changed_at"`
+}
+
+// DiffOrders сравнивает два заказа по полям JSON модели, результат упорядочен по имени поля.
+func DiffOrders(old, new Order) ([]FieldChange, error) {
+	oldFields, err := flattenOrder(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flattenOrder(new)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]FieldChange, 0)
+	for field, oldValue := range oldFields {
+		newValue, ok := newFields[field]
+		if !ok || !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	for field, newValue := range newFields {
+		if _, ok := oldFields[field]; !ok {
+			changes = append(changes, FieldChange{Field: field, New: newValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// flattenOrder раскладывает заказ в мапу путь поля -> значение.
+func flattenOrder(ord Order) (map[string]interface{}, error) {
+	data, err := json.Marshal(ord)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	flatten("", tree, fields)
+	return fields, nil
+}
+
+// flatten рекурсивно обходит разобранный JSON.
+func flatten(prefix string, node interface{}, fields map[string]interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix == "" {
+				flatten(key, child, fields)
+			} else {
+				flatten(prefix+"."+key, child, fields)
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fields[prefix] = v
+		}
+		for i, child := range v {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), child, fields)
+		}
+	default:
+		fields[prefix] = v
+	}
+}
+
+// historySnapshot возвращает снимок заказа uid версии version из истории или nil, если такой записи нет.
+func historySnapshot(ctx context.Context, tx pgx.Tx, uid string, version int) (*Order, error) {
+	var snapshot []byte
+	err := tx.QueryRow(ctx, "select snapshot from order_history where OrderUID = $1 and version = $2 order by id limit 1", uid, version).Scan(&snapshot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select snapshot of order %s version %d: %w", uid, version, err)
+	}
+	var ord Order
+	err = json.Unmarshal(snapshot, &ord)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal order snapshot: %w", err)
+	}
+	return &ord, nil
+}
+
+// insertHistory записывает запись истории в той же транзакции, что и сам заказ.
+func insertHistory(ctx context.Context, tx pgx.Tx, entry OrderHistoryEntry) error {
+	snapshot, err := json.Marshal(entry.Snapshot)
+	if err != nil {
+		return fmt.Errorf("marshal order snapshot: %w", err)
+	}
+	diff, err := json.Marshal(entry.Diff)
+	if err != nil {
+		return fmt.Errorf("marshal order diff: %w", err)
+	}
+	query := "INSERT INTO order_history (OrderUID, version, change, snapshot, diff, sequence, changed_at)	Values ($1, $2, $3, $4, $5, $6, $7)"
+	_, err = tx.Exec(ctx, query, entry.Snapshot.OrderUID, entry.Version, entry.Change, snapshot, diff, int64(entry.Sequence), entry.ChangedAt)
+	if err != nil {
+		return fmt.Errorf("insert to order_history: %w", err)
+	}
+	return nil
+}
+
+// History возвращает историю заказа от первой версии к последней.
+func (r *PgRepository) History(ctx context.Context, uid string) ([]OrderHistoryEntry, error) {
+	query := `select version, change, snapshot, diff, coalesce(sequence, 0), changed_at 
+		from order_history 
+		where OrderUID = $1 
+		order by id`
+	rows, err := r.Pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, fmt.Errorf("select from order_history: %w", err)
+	}
+	defer rows.Close()
+	list := make([]OrderHistoryEntry, 0)
+	for rows.Next() {
+		var entry OrderHistoryEntry
+		var snapshot, diff []byte
+		var seq int64
+		err = rows.Scan(&entry.Version, &entry.Change, &snapshot, &diff, &seq, &entry.ChangedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scanning order history: %w", err)
+		}
+		err = json.Unmarshal(snapshot, &entry.Snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal order snapshot: %w", err)
+		}
+		err = json.Unmarshal(diff, &entry.Diff)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal order diff: %w", err)
+		}
+		entry.Sequence = uint64(seq)
+		list = append(list, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		// Заказы, сохраненные до появления истории, в ней не записаны
+		exists, err := r.Exists(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrOrderNotFound
+		}
+	}
+	return list, nil
+}
+
+// History возвращает копию истории заказа.
+func (r *MemoryRepository) History(ctx context.Context, uid string) ([]OrderHistoryEntry, error) {
+	r.RLock()
+	defer r.RUnlock()
+	// История удаленного заказа остается, поэтому неизвестен только заказ без истории
+	if len(r.history[uid]) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	return append([]OrderHistoryEntry{}, r.history[uid]...), nil
+}
+
+/*
+OrdersHandler обработчик Http запросов к /orders/.
+GET /orders/{uid}/history отдает историю изменений заказа в JSON,
+DELETE /orders/{uid} удаляет заказ (см. Skz.DeleteOrder).
+*/
+func (o *Skz) OrdersHandler(Writer http.ResponseWriter, Request *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(Request.URL.Path, "/orders/"), "/"), "/")
+	if len(parts) == 1 && Request.Method == "DELETE" {
+		o.deleteOrder(Writer, Request, parts[0])
+		return
+	}
+	if len(parts) != 2 || parts[1] != "history" {
+		http.NotFound(Writer, Request)
+		return
+	}
+	if Request.Method != "GET" {
+		http.Error(Writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	uid := parts[0]
+	err := ValidateOrderUID(uid)
+	if err != nil {
+		http.Error(Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	history, err := o.Repo.History(Request.Context(), uid)
+	if errors.Is(err, ErrOrderNotFound) {
+		http.Error(Writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(Writer, err.Error(), http.StatusInternalServerError)
+		fmt.Println(time.Now(), "Reading history of", uid, "failed:", err)
+		return
+	}
+	Writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(Writer).Encode(history)
+	if err != nil {
+		fmt.Println(time.Now(), "Encoding order history failed:", err)
+	}
+}
+
+// deleteOrder обрабатывает DELETE /orders/{uid}: 204 после удаления, 404 если заказа нет.
+func (o *Skz) deleteOrder(Writer http.ResponseWriter, Request *http.Request, uid string) {
+	err := ValidateOrderUID(uid)
+	if err != nil {
+		http.Error(Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = o.DeleteOrder(Request.Context(), uid)
+	if errors.Is(err, ErrOrderNotFound) {
+		http.Error(Writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(Writer, err.Error(), http.StatusInternalServerError)
+		fmt.Println(time.Now(), "Deleting order", uid, "failed:", err)
+		return
+	}
+	Writer.WriteHeader(http.StatusNoContent)
+}
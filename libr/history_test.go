@@ -0,0 +1,142 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getHistory запрашивает GET /orders/{uid}/history и разбирает ответ, если он 200.
+func getHistory(t *testing.T, o *Skz, uid string) (int, []OrderHistoryEntry) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	o.OrdersHandler(w, httptest.NewRequest("GET", "/orders/"+uid+"/history", nil))
+	var history []OrderHistoryEntry
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, history
+}
+
+func TestDeleteKeepsHistory(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	ord := *NewStrGen()
+	if err := repo.Save(context.TODO(), ord, 1); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	o.OrdersHandler(w, httptest.NewRequest("DELETE", "/orders/"+ord.OrderUID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", w.Code)
+	}
+	if _, err := repo.GetByUID(context.TODO(), ord.OrderUID); err != ErrOrderNotFound {
+		t.Fatalf("deleted order: got %v, want ErrOrderNotFound", err)
+	}
+	code, history := getHistory(t, o, ord.OrderUID)
+	if code != http.StatusOK || len(history) != 2 {
+		t.Fatalf("history after delete: status %d, %d entries", code, len(history))
+	}
+	last := history[1]
+	if last.Change != ChangeDelete || last.Version != 1 || last.Snapshot.OrderUID != ord.OrderUID {
+		t.Fatalf("last entry: change %q, version %d, snapshot of %q", last.Change, last.Version, last.Snapshot.OrderUID)
+	}
+}
+
+// diffFields собирает изменения по имени поля.
+func diffFields(t *testing.T, old, new Order) map[string]FieldChange {
+	t.Helper()
+	diff, err := DiffOrders(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]FieldChange, len(diff))
+	for _, change := range diff {
+		fields[change.Field] = change
+	}
+	return fields
+}
+
+func TestDiffOrders(t *testing.T) {
+	ord := *NewStrGen()
+	ord.Items = NewItemsGen(2, ord.TrackNumber)
+
+	if diff, _ := DiffOrders(ord, ord); len(diff) != 0 {
+		t.Fatalf("same order has %d changes", len(diff))
+	}
+
+	changed := copyOrder(ord)
+	changed.Deliveries.Address = "corrected"
+	fields := diffFields(t, ord, changed)
+	if len(fields) != 1 || fields["delivery.address"].Old != ord.Deliveries.Address || fields["delivery.address"].New != "corrected" {
+		t.Fatalf("nested field change: %+v", fields)
+	}
+
+	added := copyOrder(ord)
+	added.Items = append(added.Items, NewItemsGen(1, ord.TrackNumber)...)
+	fields = diffFields(t, ord, added)
+	if c, ok := fields["items[2].rid"]; !ok || c.Old != nil || c.New != added.Items[2].Rid {
+		t.Fatalf("added item: %+v", fields)
+	}
+	for field := range fields {
+		if !strings.HasPrefix(field, "items[2].") {
+			t.Errorf("adding an item changed %s", field)
+		}
+	}
+
+	removed := copyOrder(ord)
+	removed.Items = removed.Items[:1]
+	fields = diffFields(t, ord, removed)
+	if c, ok := fields["items[1].rid"]; !ok || c.Old != ord.Items[1].Rid || c.New != nil {
+		t.Fatalf("removed item: %+v", fields)
+	}
+
+	// Пустой список товаров остается полем, иначе удаление последнего товара не видно
+	empty := copyOrder(ord)
+	empty.Items = []Item{}
+	if _, ok := diffFields(t, ord, empty)["items"]; !ok {
+		t.Fatal("removing all items is not reported as items change")
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	ord := *NewStrGen()
+	if err := repo.Save(context.TODO(), ord, 1); err != nil {
+		t.Fatal(err)
+	}
+	updated := copyOrder(ord)
+	updated.Version = 2
+	updated.Deliveries.City = "other city"
+	if err := repo.Update(context.TODO(), updated, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	code, history := getHistory(t, o, ord.OrderUID)
+	if code != http.StatusOK || len(history) != 2 {
+		t.Fatalf("history: status %d, %d entries", code, len(history))
+	}
+	if history[0].Change != ChangeCreate || len(history[0].Diff) != 0 || history[0].Sequence != 1 {
+		t.Errorf("create entry: %+v", history[0])
+	}
+	second := history[1]
+	if second.Change != ChangeUpdate || second.Version != 2 || second.Sequence != 2 || second.Snapshot.Deliveries.City != "other city" {
+		t.Errorf("update entry: change %q, version %d, sequence %d", second.Change, second.Version, second.Sequence)
+	}
+	if len(second.Diff) != 2 || second.Diff[0].Field != "delivery.city" || second.Diff[1].Field != "version" {
+		t.Errorf("update diff: %+v", second.Diff)
+	}
+
+	if code, _ = getHistory(t, o, "missing"); code != http.StatusNotFound {
+		t.Errorf("history of unknown order: status %d, want 404", code)
+	}
+	w := httptest.NewRecorder()
+	o.OrdersHandler(w, httptest.NewRequest("POST", "/orders/"+ord.OrderUID+"/history", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST history: status %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package libr
+
+import "time"
+
+// IndexFunc возвращает значения вторичного индекса для записи кэша, например номера товаров заказа.
+type IndexFunc[V any] func(value V) []string
+
+// Имена вторичных индексов кэша заказов.
+const (
+	IndexTrackNumber = "track_number"
+	IndexCustomerID  = "customer_id"
+	IndexTransaction = "transaction"
+	IndexRid         = "rid"
+)
+
+// OrderIndexes вторичные индексы кэша заказов: трек-номер, покупатель, транзакция платежа и rid товаров.
+func OrderIndexes() map[string]IndexFunc[Order] {
+	return map[string]IndexFunc[Order]{
+		IndexTrackNumber: func(ord Order) []string { return []string{ord.TrackNumber} },
+		IndexCustomerID:  func(ord Order) []string { return []string{ord.CustomerID} },
+		IndexTransaction: func(ord Order) []string { return []string{ord.Pays.Transaction} },
+		IndexRid: func(ord Order) []string {
+			rids := make([]string, 0, len(ord.Items))
+			for _, item := range ord.Items {
+				rids = append(rids, item.Rid)
+			}
+			return rids
+		},
+	}
+}
+
+// indexLocked добавляет запись во вторичные индексы, вызывается под блокировкой.
+func (c *Cache[K, V]) indexLocked(key K, value V) {
+	for name, fn := range c.indexes {
+		idx := c.indexed[name]
+		if idx == nil {
+			idx = make(map[string]map[K]struct{})
+			c.indexed[name] = idx
+		}
+		for _, v := range fn(value) {
+			if v == "" {
+				continue
+			}
+			if idx[v] == nil {
+				idx[v] = make(map[K]struct{})
+			}
+			idx[v][key] = struct{}{}
+		}
+	}
+}
+
+// unindexLocked убирает запись из вторичных индексов, вызывается под блокировкой.
+func (c *Cache[K, V]) unindexLocked(key K, value V) {
+	for name, fn := range c.indexes {
+		idx := c.indexed[name]
+		for _, v := range fn(value) {
+			delete(idx[v], key)
+			if len(idx[v]) == 0 {
+				delete(idx, v)
+			}
+		}
+	}
+}
+
+/*
+Lookup ищет неустаревшие записи по значению вторичного индекса name.
+Для неизвестного индекса или значения возвращает пустой список.
+*/
+func (c *Cache[K, V]) Lookup(name, value string) []V {
+	c.RLock()
+	defer c.RUnlock()
+	now := time.Now().UnixNano()
+	found := make([]V, 0)
+	for key := range c.indexed[name][value] {
+		item := c.items[key]
+		if item.Expiration > 0 && now > item.Expiration {
+			continue
+		}
+		found = append(found, item.Value)
+	}
+	return found
+}
@@ -0,0 +1,106 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Причины сброса заказа в кэшах других копий сервиса.
+const (
+	InvalidateCreate = "create"
+	InvalidateUpdate = "update"
+	InvalidateDelete = "delete"
+)
+
+/*
+Invalidation сообщение о том, что заказ изменился и его нужно убрать из кэша.
+Рассылается через обычный NATS (без streaming): пропущенное сообщение не страшно,
+запись в кэше все равно устареет по времени. InstanceID это ClientID отправителя,
+свои же сообщения копия сервиса пропускает.
+*/
+type Invalidation struct {
+	InstanceID string `json:"instance_id"`
+	OrderUID   string `json:"order_uid"`
+	Reason     string `json:"reason"`
+}
+
+/*
+PublishInvalidation сообщает остальным копиям сервиса, что заказ uid изменился.
+Создание тоже рассылается: у других копий мог быть запомнен промах по этому номеру.
+Без подключения или с пустым InvalidationSubject ничего не делает, ошибки только логируются.
+*/
+func (o *Skz) PublishInvalidation(uid, reason string) {
+	nc := o.natsConn()
+	if o.Stream.InvalidationSubject == "" || nc == nil {
+		return
+	}
+	data, err := json.Marshal(Invalidation{InstanceID: o.Stream.ClientID, OrderUID: uid, Reason: reason})
+	if err != nil {
+		fmt.Println(time.Now(), "Marshaling invalidation of", uid, "failed:", err)
+		return
+	}
+	err = nc.Publish(o.Stream.InvalidationSubject, data)
+	if err != nil {
+		fmt.Println(time.Now(), "Publishing invalidation of", uid, "failed:", err)
+	}
+}
+
+// SubscribeInvalidations подписывается на сообщения о сбросе кэша от других копий сервиса.
+func (o *Skz) SubscribeInvalidations() (*nats.Subscription, error) {
+	if o.Stream.InvalidationSubject == "" {
+		return nil, errors.New("invalidation subject is not set")
+	}
+	nc := o.natsConn()
+	if nc == nil {
+		return nil, errors.New("not connected to nats")
+	}
+	return nc.Subscribe(o.Stream.InvalidationSubject, o.InvalidationHandler)
+}
+
+// natsConn подключение для сброса кэша: NatsConn, а если он не задан, то подключение под StreamConn.
+func (o *Skz) natsConn() *nats.Conn {
+	if o.NatsConn != nil {
+		return o.NatsConn
+	}
+	if o.StreamConn != nil {
+		return o.StreamConn.NatsConn()
+	}
+	return nil
+}
+
+// InvalidationHandler убирает из кэша заказ, измененный другой копией сервиса.
+func (o *Skz) InvalidationHandler(m *nats.Msg) {
+	var inv Invalidation
+	err := json.Unmarshal(m.Data, &inv)
+	if err != nil {
+		fmt.Println(time.Now(), "Bad invalidation message:", err)
+		return
+	}
+	if inv.InstanceID == o.Stream.ClientID {
+		return
+	}
+	// Delete сбрасывает и запомненный промах, поэтому ошибку "нет ключа" не логируем
+	if o.Cash.Delete(inv.OrderUID) == nil {
+		fmt.Println(time.Now(), "Order", inv.OrderUID, "invalidated by", inv.InstanceID, ":", inv.Reason)
+	}
+}
+
+/*
+DeleteOrder удаляет заказ из хранилища и кэша и рассылает сброс остальным копиям сервиса.
+Если заказа нет в хранилище, возвращает ErrOrderNotFound.
+*/
+func (o *Skz) DeleteOrder(ctx context.Context, uid string) error {
+	err := o.Repo.Delete(ctx, uid)
+	if err != nil {
+		return err
+	}
+	o.Cash.Delete(uid)
+	o.PublishInvalidation(uid, InvalidateDelete)
+	fmt.Println(time.Now(), "Order", uid, "deleted")
+	return nil
+}
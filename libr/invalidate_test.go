@@ -0,0 +1,124 @@
+package libr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runNatsServer запускает NATS сервер в процессе теста на свободном порту.
+func runNatsServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// newInvalidatingSkz собирает копию сервиса с общим хранилищем repo и своим подключением к NATS.
+func newInvalidatingSkz(t *testing.T, url, clientID string, repo *MemoryRepository) (*Skz, *ackRecorder) {
+	o, _, acks := newTestSkz()
+	o.Repo = repo
+	o.Stream.ClientID = clientID
+	o.Stream.InvalidationSubject = "orders.invalidate"
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	o.NatsConn = nc
+	_, err = o.SubscribeInvalidations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Подписка должна дойти до сервера раньше первых сообщений
+	err = nc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, acks
+}
+
+// waitEvicted ждет, пока заказ uid пропадет из кэша копии o.
+func waitEvicted(t *testing.T, o *Skz, uid string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := o.Cash.Get(uid); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %s is still cached on %s", uid, o.Stream.ClientID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInvalidationBetweenInstances(t *testing.T) {
+	s := runNatsServer(t)
+	repo := NewMemoryRepository()
+	a, acksA := newInvalidatingSkz(t, s.ClientURL(), "instance-a", repo)
+	b, _ := newInvalidatingSkz(t, s.ClientURL(), "instance-b", repo)
+
+	ord := *NewStrGen()
+	a.MesageHandler(fakeMsg(1, mustJSON(t, ord)))
+	if acksA.count(1) != 1 {
+		t.Fatal("create is not acked")
+	}
+	// Вторая копия успела прочитать заказ и держит его в кэше
+	if _, err := b.FromDbToCacheByKey(ord.OrderUID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		updated := ord
+		updated.Deliveries.Address = "corrected " + ord.Deliveries.Address
+		a.MesageHandler(fakeMsg(2, mustJSON(t, NewUpdateEvent(updated, 2))))
+		waitEvicted(t, b, ord.OrderUID)
+		// Свое же сообщение отправитель пропускает, новая версия остается в его кэше
+		time.Sleep(100 * time.Millisecond)
+		cached, ok := a.Cash.Get(ord.OrderUID)
+		if !ok || cached.Version != 2 {
+			t.Fatalf("sender cache: found %v, version %d", ok, cached.Version)
+		}
+		fresh, err := b.FromDbToCacheByKey(ord.OrderUID)
+		if err != nil || fresh.Version != 2 {
+			t.Fatalf("second instance reloaded version %d, err %v", fresh.Version, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if _, ok := b.Cash.Get(ord.OrderUID); !ok {
+			t.Fatal("order is not cached on the second instance")
+		}
+		err := a.DeleteOrder(context.Background(), ord.OrderUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitEvicted(t, b, ord.OrderUID)
+		if _, ok := a.Cash.Get(ord.OrderUID); ok {
+			t.Fatal("deleted order is still cached on the sender")
+		}
+	})
+
+	t.Run("ignores own messages", func(t *testing.T) {
+		other := *NewStrGen()
+		a.Cash.Set(other.OrderUID, other, 0)
+		a.PublishInvalidation(other.OrderUID, InvalidateUpdate)
+		if err := a.NatsConn.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := a.Cash.Get(other.OrderUID); !ok {
+			t.Fatal("sender evicted the order by its own invalidation")
+		}
+	})
+}
@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
 )
 
@@ -34,7 +36,7 @@ NewDeliveryGen метод для генерации структуры дост
 */
 func NewDeliveryGen() *Delivery {
 	var i = rand.Int()
-	return &Delivery{Name: "name" + strconv.Itoa(i), Phone: "phone" + strconv.Itoa(i), Zip: "zip" + strconv.Itoa(i), City: "city" + strconv.Itoa(i), Address: "address" + strconv.Itoa(i), Region: "region" + strconv.Itoa(i), Email: "email" + strconv.Itoa(i)}
+	return &Delivery{Name: "name" + strconv.Itoa(i), Phone: "+7" + strconv.Itoa(9000000000+i%1000000000), Zip: strconv.Itoa(100000 + i%900000), City: "city" + strconv.Itoa(i), Address: "address" + strconv.Itoa(i), Region: "region" + strconv.Itoa(i), Email: "email" + strconv.Itoa(i) + "@example.com"}
 }
 
 // Payment структура для платежей.
@@ -53,11 +55,13 @@ type Payment struct {
 
 /*
 NewPaymentGen генератор платежей, заполняет поля псевдослучайными значения.
+Суммы товаров в платеже и итоговую сумму выставляет NewStrGen, когда товары уже известны.
 */
 
 func NewPaymentGen() *Payment {
 	var i = rand.Int()
-	return &Payment{Transaction: "transaction" + strconv.Itoa(i), RequestID: "requestID" + strconv.Itoa(i), Currency: "currency" + strconv.Itoa(i), Provider: "provider" + strconv.Itoa(i), Amount: i, PaymentDt: i, Bank: "bank" + strconv.Itoa(i), DeliveryCost: i, GoodsTotal: i, CustomFee: i}
+	var cost = rand.Intn(1000)
+	return &Payment{Transaction: "transaction" + strconv.Itoa(i), RequestID: "requestID" + strconv.Itoa(i), Currency: "RUB", Provider: "provider" + strconv.Itoa(i), Amount: cost, PaymentDt: int(time.Now().Unix()), Bank: "bank" + strconv.Itoa(i), DeliveryCost: cost, GoodsTotal: 0, CustomFee: 0}
 }
 
 // Item структура для товаров.
@@ -77,15 +81,17 @@ type Item struct {
 
 /*
 NewItemsGen главное отличие этого генератора в том, что он возвращает массив структур Item заданной длины.
+Цена со скидкой считается из цены и процента скидки, трек номер у всех товаров общий с заказом.
 */
 
-func NewItemsGen(number int) []Item {
+func NewItemsGen(number int, trackNumber string) []Item {
 	It := make([]Item, number)
-	number--
 	for number > 0 {
-		var i = rand.Int()
-		It[number] = Item{ChrtID: i, TrackNumber: "trackNumber" + strconv.Itoa(i), Price: i, Rid: "rid" + strconv.Itoa(i), Name: "name" + strconv.Itoa(i), Sale: i, Size: "size" + strconv.Itoa(i), TotalPrice: i, NmID: i, Brand: "brand" + strconv.Itoa(i), Status: i}
 		number--
+		var i = rand.Int()
+		var price = 1 + rand.Intn(100000)
+		var sale = rand.Intn(100)
+		It[number] = Item{ChrtID: 1 + i%1000000000, TrackNumber: trackNumber, Price: price, Rid: "rid" + strconv.Itoa(i), Name: "name" + strconv.Itoa(i), Sale: sale, Size: "size" + strconv.Itoa(i), TotalPrice: price * (100 - sale) / 100, NmID: 1 + i%1000000000, Brand: "brand" + strconv.Itoa(i), Status: 202}
 	}
 	return It
 }
@@ -109,53 +115,181 @@ type Order struct {
 	SmID              int       `json:"sm_id"`
 	DateCreated       time.Time `json:"date_created"`
 	OofShard          string    `json:"oof_shard"`
+	Version           int       `json:"version"`
 }
 
 /*
 NewStrGen генератор заказов, собирает из других генераторов заказ.
-Массив Item генерируется случайной длины в пределах 10 элементов
+Массив Item генерируется случайной длины от 1 до 10 элементов, суммы в платеже сходятся с товарами.
 */
 
 func NewStrGen() *Order {
 	var i = rand.Int()
-	var j = rand.Intn(10)
+	var j = 1 + rand.Intn(10)
+	var track = "trackNumber" + strconv.Itoa(i)
 	var D = NewDeliveryGen()
 	var P = NewPaymentGen()
-	var I = NewItemsGen(j)
-	return &Order{OrderUID: "orderUID" + strconv.Itoa(i), TrackNumber: "trackNumber" + strconv.Itoa(i), Entry: "entry" + strconv.Itoa(i), Deliveries: *D, Pays: *P, Items: I, Locale: "locale" + strconv.Itoa(i), InternalSignature: "internalSignature" + strconv.Itoa(i), CustomerID: "customerID" + strconv.Itoa(i), DeliveryService: "deliveryService" + strconv.Itoa(i), Shardkey: "shardkey" + strconv.Itoa(i), SmID: i, DateCreated: time.Now().Add(time.Duration(i) * time.Millisecond), OofShard: "oofShard" + strconv.Itoa(i)}
+	var I = NewItemsGen(j, track)
+	for _, it := range I {
+		P.GoodsTotal += it.TotalPrice
+	}
+	P.Amount = P.GoodsTotal + P.DeliveryCost + P.CustomFee
+	return &Order{OrderUID: "orderUID" + strconv.Itoa(i), TrackNumber: track, Entry: "entry" + strconv.Itoa(i), Deliveries: *D, Pays: *P, Items: I, Locale: "en", InternalSignature: "internalSignature" + strconv.Itoa(i), CustomerID: "customerID" + strconv.Itoa(i), DeliveryService: "deliveryService" + strconv.Itoa(i), Shardkey: "shardkey" + strconv.Itoa(i), SmID: i % 1000, DateCreated: time.Now(), OofShard: "oofShard" + strconv.Itoa(i)}
 }
 
 /*
 ItemForCache структура данных для хранения информации в кэше.
+Size примерный размер записи в байтах, считается только если у кэша задан лимит по байтам.
 */
 
-type ItemForCache struct {
-	Value      interface{}
+type ItemForCache[V any] struct {
+	Value      V
 	Created    time.Time
 	Expiration int64
+	Size       int64
 }
 
 /*
-Cache работает на структуре данных Map, ключ это OrderUID,
+Cache работает на структуре данных Map, типы ключа и значения задаются параметрами,
+для заказов это OrderCache: ключ OrderUID, значение Order.
+Размер кэша можно ограничить числом записей и примерным объемом в байтах,
+лишние записи вытесняются по выбранной политике (LRU, LFU или TTL).
 */
 
-type Cache struct {
+type Cache[K comparable, V any] struct {
+	// счетчики меняются атомарно, стоят первыми ради выравнивания на 32-битных платформах
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
 	sync.RWMutex
 	defaultExpiration time.Duration
 	cleanupInterval   time.Duration
-	items             map[string]ItemForCache
+	items             map[K]ItemForCache[V]
+	maxEntries        int
+	maxBytes          int64
+	bytes             int64
+	sizer             func(key K, value V) int64
+	policy            EvictionPolicy[K]
+	gcCancel          context.CancelFunc
+	gcDone            chan struct{}
+	onEvicted         func(key K, value V, reason EvictionReason)
+	onExpired         func(key K, value V, reason EvictionReason)
+	removed           []removedItem[K, V]
+	loads             map[K]*loadCall[V]
+	negative          map[K]negativeItem
+	negativeTTL       time.Duration
+	isNegative        func(err error) bool
+	indexes           map[string]IndexFunc[V]
+	indexed           map[string]map[string]map[K]struct{}
+}
+
+// EvictionReason причина, по которой запись ушла из кэша.
+type EvictionReason int
+
+const (
+	// EvictionExpired запись устарела и убрана сборщиком мусора.
+	EvictionExpired EvictionReason = iota
+	// EvictionCapacity запись вытеснена из-за лимита записей или байт.
+	EvictionCapacity
+	// EvictionDeleted запись удалена через Delete.
+	EvictionDeleted
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// removedItem запись, о которой нужно сообщить обработчикам после снятия блокировки.
+type removedItem[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictionReason
+}
+
+// orderTTL время хранения заказа в кэше, которое Skz задает при любой записи в кэш.
+const orderTTL = 5 * time.Minute
+
+// OrderCache кэш заказов, с которым работает Skz.
+type OrderCache = Cache[string, Order]
+
+/*
+CacheOptions настройки кэша. MaxEntries и MaxBytes равные 0 означают отсутствие лимита.
+Если лимит задан, а Policy нет, используется LRU. Sizer считает размер записи,
+по умолчанию это длина значения в JSON.
+*/
+type CacheOptions[K comparable, V any] struct {
+	DefaultExpiration time.Duration
+	CleanupInterval   time.Duration
+	MaxEntries        int
+	MaxBytes          int64
+	Sizer             func(key K, value V) int64
+	Policy            EvictionPolicy[K]
+	// NewPolicy создает политику, если Policy не задана; ShardedCache вызывает его для каждой части.
+	NewPolicy func() EvictionPolicy[K]
+	// OnEvicted вызывается для любой ушедшей из кэша записи, OnExpired только для устаревших.
+	OnEvicted func(key K, value V, reason EvictionReason)
+	OnExpired func(key K, value V, reason EvictionReason)
+	// IsNegative отбирает ошибки загрузчика в GetOrLoad, которые запоминаются на NegativeTTL (например, заказа нет).
+	IsNegative  func(err error) bool
+	NegativeTTL time.Duration
+	// Indexes вторичные индексы по имени, искать по ним можно через Lookup.
+	Indexes map[string]IndexFunc[V]
+}
+
+// JSONSize примерный размер значения: длина его JSON представления.
+func JSONSize[K comparable, V any](key K, value V) int64 {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
 }
 
 // NewCatch создает мапу и прописывает время хранения данных в ней
-func NewCatch(defaultExpiration, cleanupInterval time.Duration) *Cache {
-	items := make(map[string]ItemForCache)
-	cache := Cache{
+func NewCatch[K comparable, V any](defaultExpiration, cleanupInterval time.Duration) *Cache[K, V] {
+	return NewCacheWithOptions(CacheOptions[K, V]{DefaultExpiration: defaultExpiration, CleanupInterval: cleanupInterval})
+}
+
+// NewCacheWithOptions создает кэш с лимитами и политикой вытеснения.
+func NewCacheWithOptions[K comparable, V any](opts CacheOptions[K, V]) *Cache[K, V] {
+	items := make(map[K]ItemForCache[V])
+	cache := Cache[K, V]{
 		items:             items,
-		defaultExpiration: defaultExpiration,
-		cleanupInterval:   cleanupInterval,
+		defaultExpiration: opts.DefaultExpiration,
+		cleanupInterval:   opts.CleanupInterval,
+		maxEntries:        opts.MaxEntries,
+		maxBytes:          opts.MaxBytes,
+		sizer:             opts.Sizer,
+		policy:            opts.Policy,
+		onEvicted:         opts.OnEvicted,
+		onExpired:         opts.OnExpired,
+		loads:             make(map[K]*loadCall[V]),
+		negative:          make(map[K]negativeItem),
+		negativeTTL:       opts.NegativeTTL,
+		isNegative:        opts.IsNegative,
+		indexes:           opts.Indexes,
+		indexed:           make(map[string]map[string]map[K]struct{}),
+	}
+	if cache.maxBytes > 0 && cache.sizer == nil {
+		cache.sizer = JSONSize[K, V]
+	}
+	if cache.policy == nil && opts.NewPolicy != nil {
+		cache.policy = opts.NewPolicy()
+	}
+	if (cache.maxEntries > 0 || cache.maxBytes > 0) && cache.policy == nil {
+		cache.policy = NewLRUPolicy[K]()
 	}
-	// Если интервал очистки больше 0, запускаем удаление устаревших элементов
-	if cleanupInterval > 0 {
+	// Если интервал очистки больше 0, запускаем удаление устаревших элементов, остановить его можно через Close
+	if cache.cleanupInterval > 0 {
 		cache.StartGC() // данный метод рассматривается ниже
 	}
 	return &cache
@@ -166,7 +300,31 @@ Set добавляет данные в мапу и присваевает им 
 проверка на ключ включена, если ключ уже есть в мапе перезаписи не будет.
 */
 
-func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
+func (c *Cache[K, V]) Set(key K, value V, duration time.Duration) {
+	defer c.notifyRemoved()
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.items[key]; ok == true {
+		fmt.Println("Key is not unique. Thai is already data for this key. Overwriting is not allowed")
+		return
+	}
+	c.setLocked(key, value, duration)
+}
+
+/*
+Replace записывает данные по ключу, даже если они уже есть в мапе.
+Используется для обновлений заказа, когда старая версия должна уйти из кэша.
+*/
+func (c *Cache[K, V]) Replace(key K, value V, duration time.Duration) {
+	defer c.notifyRemoved()
+	c.Lock()
+	defer c.Unlock()
+	c.invalidateLoadLocked(key)
+	c.setLocked(key, value, duration)
+}
+
+// setLocked записывает данные и вытесняет лишнее, вызывается под блокировкой.
+func (c *Cache[K, V]) setLocked(key K, value V, duration time.Duration) {
 	var expiration int64
 	if duration == 0 {
 		duration = c.defaultExpiration
@@ -175,72 +333,232 @@ func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
 	if duration > 0 {
 		expiration = time.Now().Add(duration).UnixNano()
 	}
-	c.Lock()
-	defer c.Unlock()
-	if _, ok := c.items[key]; ok == true {
-		fmt.Println("Key is not unique. Thai is already data for this key. Overwriting is not allowed")
-		return
+	// Значение появилось, запомненная ошибка загрузки больше не верна
+	delete(c.negative, key)
+	c.putLocked(key, value, time.Now(), expiration)
+}
+
+// putLocked записывает данные с готовыми временем записи и истечения, вызывается под блокировкой.
+func (c *Cache[K, V]) putLocked(key K, value V, created time.Time, expiration int64) {
+	var size int64
+	if c.sizer != nil {
+		size = c.sizer(key, value)
+	}
+	if old, ok := c.items[key]; ok {
+		c.bytes -= old.Size
+		c.unindexLocked(key, old.Value)
 	}
-	c.items[key] = ItemForCache{
+	c.indexLocked(key, value)
+	c.items[key] = ItemForCache[V]{
 		Value:      value,
 		Expiration: expiration,
-		Created:    time.Now(),
+		Created:    created,
+		Size:       size,
+	}
+	c.bytes += size
+	if c.policy != nil {
+		c.policy.Added(key, expiration)
+	}
+	c.evictLocked(key)
+}
+
+// overLimit проверяет, превышены ли лимиты кэша.
+func (c *Cache[K, V]) overLimit() bool {
+	return (c.maxEntries > 0 && len(c.items) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+/*
+evictLocked вытесняет записи по политике, пока кэш не уложится в лимиты. Только что записанный ключ keep остается:
+если политика выбирает его (для LFU это обычное дело, у новой записи меньше всех обращений),
+он на время убирается из политики, и вытесняется следующий кандидат.
+*/
+func (c *Cache[K, V]) evictLocked(keep K) {
+	if c.policy == nil {
+		return
+	}
+	hidden := false
+	for c.overLimit() {
+		victim, ok := c.policy.Victim()
+		if ok && victim == keep {
+			c.policy.Removed(keep)
+			hidden = true
+			continue
+		}
+		if !ok {
+			// Осталась только новая запись, которая сама больше лимита
+			break
+		}
+		c.removeLocked(victim, EvictionCapacity)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	if hidden {
+		c.policy.Added(keep, c.items[keep].Expiration)
+	}
+}
+
+/*
+removeLocked удаляет запись, вызывается под блокировкой.
+Если заданы обработчики, запись запоминается, чтобы сообщить о ней в notifyRemoved уже без блокировки.
+*/
+func (c *Cache[K, V]) removeLocked(key K, reason EvictionReason) {
+	item, found := c.items[key]
+	if !found {
+		return
+	}
+	c.bytes -= item.Size
+	c.unindexLocked(key, item.Value)
+	delete(c.items, key)
+	if c.policy != nil {
+		c.policy.Removed(key)
+	}
+	if c.onEvicted != nil || (c.onExpired != nil && reason == EvictionExpired) {
+		c.removed = append(c.removed, removedItem[K, V]{key: key, value: item.Value, reason: reason})
 	}
 }
 
+/*
+notifyRemoved вызывает обработчики для удаленных записей.
+Вызывается после снятия блокировки, поэтому из обработчика можно обращаться к кэшу.
+*/
+func (c *Cache[K, V]) notifyRemoved() {
+	c.Lock()
+	removed := c.removed
+	c.removed = nil
+	onEvicted, onExpired := c.onEvicted, c.onExpired
+	c.Unlock()
+	for _, r := range removed {
+		if r.reason == EvictionExpired && onExpired != nil {
+			onExpired(r.key, r.value, r.reason)
+		}
+		if onEvicted != nil {
+			onEvicted(r.key, r.value, r.reason)
+		}
+	}
+}
+
+// OnEvicted задает обработчик, который вызывается для любой ушедшей из кэша записи, nil отключает его.
+func (c *Cache[K, V]) OnEvicted(fn func(key K, value V, reason EvictionReason)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onEvicted = fn
+}
+
+// OnExpired задает обработчик, который вызывается для устаревших записей, nil отключает его.
+func (c *Cache[K, V]) OnExpired(fn func(key K, value V, reason EvictionReason)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onExpired = fn
+}
+
 // Get метод, чтобы вытащить данные из мапы по ключу.
-func (c *Cache) Get(key string) (interface{}, bool) {
-	c.RLock()
-	defer c.RUnlock()
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var zero V
+	// Политике вытеснения нужно знать об обращениях, поэтому с ней берем блокировку на запись
+	if c.policy != nil {
+		c.Lock()
+		defer c.Unlock()
+	} else {
+		c.RLock()
+		defer c.RUnlock()
+	}
 	item, found := c.items[key]
 	// ключ не найден
 	if !found {
-		return nil, false
+		atomic.AddUint64(&c.misses, 1)
+		return zero, false
 	}
 	// Проверка на установку времени истечения, в противном случае он бессрочный
 	if item.Expiration > 0 {
-		// Если в момент запроса кеш устарел возвращаем nil
+		// Если в момент запроса кеш устарел возвращаем нулевое значение
 		if time.Now().UnixNano() > item.Expiration {
-			return nil, false
+			atomic.AddUint64(&c.misses, 1)
+			return zero, false
 		}
 	}
+	if c.policy != nil {
+		c.policy.Accessed(key)
+	}
+	atomic.AddUint64(&c.hits, 1)
 	return item.Value, true
 }
 
+// Len возвращает число записей в кэше, включая еще не убранные устаревшие.
+func (c *Cache[K, V]) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.items)
+}
+
 // Delete удаляет данные по ключу, но так же используется в следующих методах.
-func (c *Cache) Delete(key string) error {
+func (c *Cache[K, V]) Delete(key K) error {
+	defer c.notifyRemoved()
 	c.Lock()
 	defer c.Unlock()
+	delete(c.negative, key)
+	// Загрузка, начатая до удаления, может вернуть старое значение
+	c.invalidateLoadLocked(key)
 	if _, found := c.items[key]; !found {
 		return errors.New("key not found")
 	}
-	delete(c.items, key)
+	c.removeLocked(key, EvictionDeleted)
 	return nil
 }
 
-// StartGC запускает сборщик мусора в отдельной рутине.
-func (c *Cache) StartGC() {
-	go c.GC()
+/*
+StartGC запускает сборщик мусора в отдельной рутине, повторный вызов ничего не делает.
+Остановить сборщик можно через Close или отменой контекста в StartGCContext.
+*/
+func (c *Cache[K, V]) StartGC() {
+	c.StartGCContext(context.Background())
+}
+
+// StartGCContext запускает сборщик мусора, который остановится при отмене ctx или вызове Close.
+func (c *Cache[K, V]) StartGCContext(ctx context.Context) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gcDone != nil || c.cleanupInterval <= 0 {
+		return
+	}
+	ctx, c.gcCancel = context.WithCancel(ctx)
+	c.gcDone = make(chan struct{})
+	go c.GC(ctx, c.gcDone)
 }
 
-// GC удаляет мусор по времени хранения.
-func (c *Cache) GC() {
+// GC удаляет мусор по времени хранения, пока не отменят ctx, после выхода закрывает done.
+func (c *Cache[K, V]) GC(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	// ожидаем время установленное в cleanupInterval
+	ticker := time.NewTicker(c.cleanupInterval)
+	defer ticker.Stop()
 	for {
-		// ожидаем время установленное в cleanupInterval
-		<-time.After(c.cleanupInterval)
-		if c.items == nil {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
 		// Ищем элементы с истёкшим временем жизни и удаляем из хранилища
 		if keys := c.expiredKeys(); len(keys) != 0 {
 			c.clearItems(keys)
-
 		}
+		c.clearNegative()
 	}
 }
 
+// Close останавливает сборщик мусора и ждет завершения его рутины. Повторный вызов ничего не делает.
+func (c *Cache[K, V]) Close() {
+	c.Lock()
+	cancel, done := c.gcCancel, c.gcDone
+	c.gcCancel, c.gcDone = nil, nil
+	c.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
 // expiredKeys даёт список ключей, у которых закончилось время.
-func (c *Cache) expiredKeys() (keys []string) {
+func (c *Cache[K, V]) expiredKeys() (keys []K) {
 	c.RLock()
 	defer c.RUnlock()
 	for k, i := range c.items {
@@ -251,15 +569,31 @@ func (c *Cache) expiredKeys() (keys []string) {
 	return
 }
 
-// clearItems чеез метод Delete и массив ключей из expiredKeys удаляет данные из мапы.
-func (c *Cache) clearItems(keys []string) {
+/*
+clearItems удаляет данные из мапы по массиву ключей из expiredKeys.
+Время проверяется еще раз: между выборкой и удалением запись могли перезаписать.
+*/
+func (c *Cache[K, V]) clearItems(keys []K) {
+	defer c.notifyRemoved()
 	c.Lock()
 	defer c.Unlock()
+	now := time.Now().UnixNano()
+	var removed uint64
 	for _, k := range keys {
-		delete(c.items, k)
+		if item, ok := c.items[k]; ok && item.Expiration > 0 && now > item.Expiration {
+			c.removeLocked(k, EvictionExpired)
+			removed++
+		}
 	}
+	atomic.AddUint64(&c.expirations, removed)
 }
 
+// ErrOrderNotFound заказа с таким номером нет в БД.
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrTooManyRedeliveries сообщение не удалось записать за StreamConfig.MaxRedeliveries доставок.
+var ErrTooManyRedeliveries = errors.New("too many redeliveries")
+
 /*
 Connector маленькая структура для подключения к Postgresql.
 Содержит в себе данные для генерации строки подключения.
@@ -277,186 +611,259 @@ func (con Connector) GetPGSQL() string {
 	return fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", con.Uname, con.Pass, con.Host, con.Port, con.Dbname)
 }
 
+/*
+StreamConfig настройки подключения и подписки на канал nats-streaming.
+Подписка durable с ручным подтверждением: сообщение подтверждается только после
+записи заказа в БД, иначе через AckWait сервер доставит его повторно.
+*/
+type StreamConfig struct {
+	ClusterID   string
+	ClientID    string
+	URL         string
+	Subject     string
+	DurableName string
+	AckWait     time.Duration
+	MaxInflight int
+	// MaxRedeliveries после стольких повторных доставок сообщение с ошибкой записи уходит в dead-letter, 0 без ограничения
+	MaxRedeliveries int
+	// DeadLetterSubject канал для сообщений, которые не удалось разобрать, пустая строка отключает отправку
+	DeadLetterSubject string
+	// InvalidationSubject канал обычного NATS для сброса кэша в других копиях сервиса, пустая строка отключает
+	InvalidationSubject string
+}
+
+// SubscriptionOptions собирает опции подписки из настроек.
+func (sc StreamConfig) SubscriptionOptions() []stan.SubscriptionOption {
+	opts := []stan.SubscriptionOption{
+		stan.DurableName(sc.DurableName),
+		stan.SetManualAckMode(),
+		// Для новой durable подписки читаем канал с начала, дальше сервер помнит позицию сам
+		stan.DeliverAllAvailable(),
+	}
+	if sc.AckWait > 0 {
+		opts = append(opts, stan.AckWait(sc.AckWait))
+	}
+	if sc.MaxInflight > 0 {
+		opts = append(opts, stan.MaxInflight(sc.MaxInflight))
+	}
+	return opts
+}
+
 /*
 Skz структура со всем, что может понадобиться по ходу работы программы.
-Здесь хранится кэш, модель заказа, а так же данные о подключениях.
+Здесь хранится кэш, хранилище заказов, а так же данные о подключениях.
+Заказы в структуре не хранятся: обработчики сообщений и Http запросов работают каждый со своей копией.
 */
 
 type Skz struct {
 	Con             Connector
-	Zakaz           Order
+	Stream          StreamConfig
 	Pool            *pgxpool.Pool
-	Cash            *Cache
+	Repo            OrderRepository
+	Cash            CacheStore[string, Order]
 	StreamConn      stan.Conn
 	StreamSubscribe stan.Subscription
+	// NatsConn подключение обычного NATS для сброса кэша, nil значит подключение под StreamConn
+	NatsConn *nats.Conn
+	// Warm настройки прогрева кэша в InitSomeCache
+	Warm WarmUpConfig
+	// ackMsg подтверждает сообщение, nil значит stan.Msg.Ack; тесты подменяют его, у поддельных сообщений нет подписки
+	ackMsg func(m *stan.Msg) error
+	// RefreshRecent заказы моложе этого возраста перечитываются из хранилища, когда устаревают в кэше, 0 отключает
+	RefreshRecent time.Duration
 }
 
 /*
 NewSkz создает новую структуру, передавая туда только конектор и временные интервалы для кэша
 */
 func NewSkz(con Connector, defaultExpiration, cleanupInterval time.Duration) *Skz {
-	return &Skz{Con: con, Cash: NewCatch(defaultExpiration, cleanupInterval)}
+	return NewSkzWithCache(con, CacheOptions[string, Order]{DefaultExpiration: defaultExpiration, CleanupInterval: cleanupInterval}, 1)
 }
 
 /*
-FromDbToCacheByKey метод структуры skz, который может подгрузить в кэш данные из БД, если в заказе есть номер.
+NewSkzWithCache создает структуру с кэшем заказов, ограниченным по настройкам opts.
+При shards больше 1 кэш разбивается на части (ShardedCache), чтобы меньше ждать блокировок.
+Если обработчики в opts не заданы, уход заказов из кэша логируется, а устаревшие свежие заказы
+перечитываются из хранилища (см. RefreshRecent).
 */
-
-func (o *Skz) FromDbToCacheByKey() error {
-	if o.Zakaz.OrderUID == "" {
-		return fmt.Errorf("key is empty")
+func NewSkzWithCache(con Connector, opts CacheOptions[string, Order], shards int) *Skz {
+	o := &Skz{Con: con, Warm: WarmUpConfig{Strategy: WarmUpRecent, Count: 1000}}
+	if opts.OnEvicted == nil {
+		opts.OnEvicted = o.orderEvicted
 	}
-	var DelId, PayId string
-	query := `
-		Select TrackNumber, Entry, Deliveries, Pays, Items, Locale, InternalSignature, CustomerID, DeliveryService, Shardkey, SmID, DateCreated, OofShard 
-		from orders 
-		where orderUID = '` + fmt.Sprint(o.Zakaz.OrderUID, "'")
-	rows, err := o.Pool.Query(context.TODO(), query)
-	if err != nil {
-		fmt.Println(time.Now(), "Select from Order failed:", err)
-		return err
+	if opts.OnExpired == nil {
+		opts.OnExpired = o.refreshExpired
 	}
-	it := make([]int, 0)
-	for rows.Next() {
-		err = rows.Scan(&o.Zakaz.TrackNumber, &o.Zakaz.Entry, &DelId, &PayId, &it, &o.Zakaz.Locale, &o.Zakaz.InternalSignature, &o.Zakaz.CustomerID, &o.Zakaz.DeliveryService, &o.Zakaz.Shardkey, &o.Zakaz.SmID, &o.Zakaz.DateCreated, &o.Zakaz.OofShard)
-		if err != nil {
-			fmt.Println(time.Now(), "Scanning rows from selected order failed:", err)
-			return err
-		}
+	// Запоминаем только отсутствие заказа, ошибки БД запоминать нельзя
+	if opts.IsNegative == nil {
+		opts.IsNegative = func(err error) bool { return errors.Is(err, ErrOrderNotFound) }
 	}
-	fmt.Println(time.Now(), "OrderUid =", o.Zakaz.OrderUID)
-
-	for i := 0; i < len(it); i++ {
-		query = `Select 
-		chrtid, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status 
-		from item 
-		where chrtid = '` + fmt.Sprint(it[i], "'")
-		rows, err = o.Pool.Query(context.TODO(), query)
-		if err != nil {
-			fmt.Println(time.Now(), "Select from Items failed:", err)
-			return err
-		}
-		for rows.Next() {
-			var utem Item
-			err = rows.Scan(&utem.ChrtID, &utem.TrackNumber, &utem.Price, &utem.Rid, &utem.Name, &utem.Sale, &utem.Size, &utem.TotalPrice, &utem.NmID, &utem.Brand, &utem.Status)
-			if err != nil {
-				fmt.Println(time.Now(), "Scanning rows from selected items failed:", err)
-				return err
-			}
-			o.Zakaz.Items = append(o.Zakaz.Items, utem)
-			fmt.Println(time.Now(), "Item =", o.Zakaz.Items[i].ChrtID, "Index =", i)
-		}
+	if opts.Indexes == nil {
+		opts.Indexes = OrderIndexes()
 	}
-	query = `Select 
-		del_name, Phone, Zip, City, Address, Region, Email 
-		from delivery 
-		where del_id = '` + fmt.Sprint(DelId, "'")
-	rows, err = o.Pool.Query(context.TODO(), query)
-	if err != nil {
-		fmt.Println(time.Now(), "Select from Delivery failed:", err)
-		return err
+	if shards > 1 {
+		o.Cash = NewShardedCache(shards, opts)
+	} else {
+		o.Cash = NewCacheWithOptions(opts)
 	}
-	for rows.Next() {
-		err = rows.Scan(&o.Zakaz.Deliveries.Name, &o.Zakaz.Deliveries.Phone, &o.Zakaz.Deliveries.Zip, &o.Zakaz.Deliveries.City, &o.Zakaz.Deliveries.Address, &o.Zakaz.Deliveries.Region, &o.Zakaz.Deliveries.Email)
-		if err != nil {
-			fmt.Println(time.Now(), "Scanning rows from selected delivery failed:", err)
-			return err
-		}
-	}
-	fmt.Println(time.Now(), "Delivery =", DelId)
-	query = `select 
-		Transaction, RequestID, Currency, Provider, Amount, PaymentDt, Bank, DeliveryCost, GoodsTotal, CustomFee
-		from payment 
-		where pay_id = '` + fmt.Sprint(PayId, "'")
-	rows, err = o.Pool.Query(context.TODO(), query)
-	if err != nil {
-		fmt.Println(time.Now(), "Select from Payment failed:", err)
-		return err
+	return o
+}
+
+// orderEvicted логирует уход заказа из кэша.
+func (o *Skz) orderEvicted(key string, ord Order, reason EvictionReason) {
+	fmt.Println(time.Now(), "Order", key, "left cache:", reason)
+}
+
+/*
+refreshExpired перечитывает из хранилища устаревший заказ, если он создан не раньше RefreshRecent назад:
+свежие заказы спрашивают чаще всего, и им лучше не пропадать из кэша.
+Чтение идет в отдельной рутине, чтобы не задерживать сборщик мусора кэша.
+*/
+func (o *Skz) refreshExpired(key string, ord Order, reason EvictionReason) {
+	if o.RefreshRecent <= 0 || o.Repo == nil || time.Since(ord.DateCreated) > o.RefreshRecent {
+		return
 	}
-	for rows.Next() {
-		err = rows.Scan(&o.Zakaz.Pays.Transaction, &o.Zakaz.Pays.RequestID, &o.Zakaz.Pays.Currency, &o.Zakaz.Pays.Provider, &o.Zakaz.Pays.Amount, &o.Zakaz.Pays.PaymentDt, &o.Zakaz.Pays.Bank, &o.Zakaz.Pays.DeliveryCost, &o.Zakaz.Pays.GoodsTotal, &o.Zakaz.Pays.CustomFee)
+	go func() {
+		fresh, err := o.Repo.GetByUID(context.TODO(), key)
 		if err != nil {
-			fmt.Println(time.Now(), "Scanning rows from selected payments failed:", err)
-			return err
+			fmt.Println(time.Now(), "Refreshing expired order", key, "failed:", err)
+			return
 		}
+		// Set не перезапишет заказ, если его уже успели положить в кэш заново
+		o.Cash.Set(key, fresh, orderTTL)
+		fmt.Println(time.Now(), "Expired order", key, "refreshed from storage")
+	}()
+}
+
+/*
+FromDbToCacheByKey метод структуры skz, который подгружает в кэш заказ из хранилища по его номеру.
+Одновременные вызовы с одним номером делают один запрос в хранилище (см. Cache.GetOrLoad).
+Если заказа с таким номером нет, возвращается ErrOrderNotFound.
+*/
+
+func (o *Skz) FromDbToCacheByKey(uid string) (Order, error) {
+	if uid == "" {
+		return Order{}, fmt.Errorf("key is empty")
 	}
-	fmt.Println(time.Now(), "Payment =", PayId)
-	o.Cash.Set(o.Zakaz.OrderUID, o.Zakaz, 5*time.Minute)
-	return nil
+	ord, _, err := o.Cash.GetOrLoad(uid, orderTTL, o.loadOrder)
+	return ord, err
+}
+
+// loadOrder загрузчик заказа из хранилища для Cache.GetOrLoad.
+func (o *Skz) loadOrder(uid string) (Order, error) {
+	return o.Repo.GetByUID(context.TODO(), uid)
 }
 
-// InitSomeCache метод для подгрузки кэша из БД, при запуске работы приложения.
+/*
+InitSomeCache метод для подгрузки кэша из хранилища при запуске работы приложения,
+какие заказы грузить, задает o.Warm. При o.Warm.Background загрузка идет в фоне, а ошибка только логируется.
+*/
 func (o *Skz) InitSomeCache() error {
-	query := `select orderuid 
-		from orders 
-		limit 
-		((select count(orderuid)from orders)/2)`
-	rows, err := o.Pool.Query(context.TODO(), query)
+	// Фоновая загрузка работает со своей копией настроек
+	cfg := o.Warm
+	err := cfg.Check()
 	if err != nil {
-		fmt.Println(time.Now(), "Query error:", err)
 		return err
 	}
-	for rows.Next() {
-		err = rows.Scan(&o.Zakaz.OrderUID)
-		if err != nil {
-			fmt.Println(time.Now(), "rows Scanning going wrong:", err)
-			return err
-		}
-		err = o.FromDbToCacheByKey()
+	load := func() error {
+		start := time.Now()
+		n, err := o.WarmUp(context.TODO(), cfg)
 		if err != nil {
-			fmt.Println(time.Now(), "Caching data from Db going wrong:", err)
+			fmt.Println(time.Now(), "Warming up cache going wrong after", n, "orders:", err)
 			return err
 		}
+		fmt.Println(time.Now(), n, "orders loaded to cache by strategy", cfg.Strategy, "in", time.Since(start))
+		return nil
 	}
-	return nil
+	if cfg.Background {
+		go load()
+		return nil
+	}
+	return load()
 }
 
-// MesageHandler обработчик сообщений из стрим канала.
+/*
+MesageHandler обработчик сообщений из стрим канала.
+Сообщение это либо заказ целиком (создание), либо событие OrderEvent с типом create или update.
+*/
 func (o *Skz) MesageHandler(m *stan.Msg) {
-	err := json.Unmarshal(m.Data, &o.Zakaz)
-	var ResultDelivery, ResultPayment, ResultOrder string
-	var ResultItems int
+	// Каждое сообщение разбирается в свою переменную, общих данных между вызовами нет
+	ev, err := ParseOrderEvent(m.Data)
 	if err != nil {
-		fmt.Println(err, "Json")
+		fmt.Println(time.Now(), "Message", m.Sequence, "is not a valid order event:", err)
+		o.rejectAndAck(m, err)
+		return
 	}
-	o.Cash.Set(o.Zakaz.OrderUID, o.Zakaz, 5*time.Minute)
-	fmt.Println(time.Now(), o.Zakaz.OrderUID, "putted in cache")
-
-	query := "INSERT INTO delivery (del_name, Phone, Zip, City, Address, Region, Email)	Values ($1, $2, $3, $4, $5, $6, $7) returning del_id"
-	err = o.Pool.QueryRow(context.TODO(), query, o.Zakaz.Deliveries.Name, o.Zakaz.Deliveries.Phone, o.Zakaz.Deliveries.Zip, o.Zakaz.Deliveries.City, o.Zakaz.Deliveries.Address, o.Zakaz.Deliveries.Region, o.Zakaz.Deliveries.Email).Scan(&ResultDelivery)
+	ord := ev.Order
+	err = ord.Validate()
 	if err != nil {
-		fmt.Println(time.Now(), "Insert to Delivery failed:", err)
-
+		fmt.Println(time.Now(), "Message", m.Sequence, "has invalid order", ord.OrderUID, ":", err)
+		o.rejectAndAck(m, err)
+		return
+	}
+	if ev.Type == EventUpdate {
+		err = o.Repo.Update(context.TODO(), ord, m.Sequence)
+	} else {
+		err = o.Repo.Save(context.TODO(), ord, m.Sequence)
+	}
+	switch {
+	case errors.Is(err, ErrOrderDuplicate):
+		// Повторная доставка уже сохраненного заказа или обновления, просто подтверждаем
+		fmt.Println(time.Now(), "Order", ord.OrderUID, "version", ord.Version, "is already saved, message", m.Sequence, "is a duplicate")
+		o.ack(m)
+		return
+	case errors.Is(err, ErrOrderConflict), errors.Is(err, ErrStaleVersion):
+		// Тот же номер с другим содержимым или устаревшая версия, отправляем на разбор
+		fmt.Println(time.Now(), "Order", ord.OrderUID, "rejected, message", m.Sequence, ":", err)
+		o.rejectAndAck(m, err)
+		return
 	}
-	fmt.Println(time.Now(), "delivery =", ResultDelivery)
-
-	query = "INSERT INTO payment (Transaction, RequestID, Currency, Provider, Amount, PaymentDt, Bank, DeliveryCost, GoodsTotal, CustomFee)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning pay_id"
-	err = o.Pool.QueryRow(context.TODO(), query, o.Zakaz.Pays.Transaction, o.Zakaz.Pays.RequestID, o.Zakaz.Pays.Currency, o.Zakaz.Pays.Provider, o.Zakaz.Pays.Amount, o.Zakaz.Pays.PaymentDt, o.Zakaz.Pays.Bank, o.Zakaz.Pays.DeliveryCost, o.Zakaz.Pays.GoodsTotal, o.Zakaz.Pays.CustomFee).Scan(&ResultPayment)
 	if err != nil {
-		fmt.Println(time.Now(), "Insert to Payment failed:", err)
+		// Ошибка, которая повторяется при каждой доставке (например, переполнение поля), иначе занимала бы
+		// место в MaxInflight навсегда, поэтому после MaxRedeliveries попыток отправляем сообщение на разбор
+		if o.Stream.MaxRedeliveries > 0 && int(m.RedeliveryCount) >= o.Stream.MaxRedeliveries {
+			fmt.Println(time.Now(), "Storing order", ord.OrderUID, "failed", m.RedeliveryCount+1, "times, giving up:", err)
+			o.rejectAndAck(m, fmt.Errorf("%w: %v", ErrTooManyRedeliveries, err))
+			return
+		}
+		// Не подтверждаем сообщение, сервер доставит его повторно по истечении AckWait.
+		// Так же обрабатываются ErrVersionGap и ErrOrderNotFound для обновления: к повтору предыдущие версии
+		// или само создание заказа уже могут прийти (например, если создание ждет повтора после сбоя).
+		fmt.Println(time.Now(), "Storing order", ord.OrderUID, "failed:", err)
+		return
 	}
-	fmt.Println(time.Now(), "payment =", ResultPayment)
-
-	it := make([]int, len(o.Zakaz.Items))
-
-	for i := 0; i < len(o.Zakaz.Items); i++ {
-		it[i] = o.Zakaz.Items[i].ChrtID
+	// В кэш заказ попадает только после успешного коммита транзакции
+	if ev.Type == EventUpdate {
+		o.Cash.Replace(ord.OrderUID, ord, orderTTL)
+		o.PublishInvalidation(ord.OrderUID, InvalidateUpdate)
+	} else {
+		o.Cash.Set(ord.OrderUID, ord, orderTTL)
+		o.PublishInvalidation(ord.OrderUID, InvalidateCreate)
 	}
+	fmt.Println(time.Now(), ord.OrderUID, "version", ord.Version, "putted in cache")
+	o.ack(m)
+}
 
-	query = "INSERT INTO orders (OrderUID, TrackNumber, Entry, Deliveries, Pays, Items, Locale, InternalSignature, CustomerID, DeliveryService, Shardkey, SmID, DateCreated, OofShard)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning OrderUID"
-	err = o.Pool.QueryRow(context.TODO(), query, o.Zakaz.OrderUID, o.Zakaz.TrackNumber, o.Zakaz.Entry, ResultDelivery, ResultPayment, it, o.Zakaz.Locale, o.Zakaz.InternalSignature, o.Zakaz.CustomerID, o.Zakaz.DeliveryService, o.Zakaz.Shardkey, o.Zakaz.SmID, o.Zakaz.DateCreated, o.Zakaz.OofShard).Scan(&ResultOrder)
+// rejectAndAck отправляет сообщение в dead-letter и подтверждает его, чтобы оно не приходило повторно.
+func (o *Skz) rejectAndAck(m *stan.Msg, reason error) {
+	err := o.RejectMessage(context.TODO(), m, reason)
 	if err != nil {
-		fmt.Println(time.Now(), "Insert to Order failed:", err)
+		// Не получилось сохранить, тогда пусть сервер доставит сообщение еще раз
+		fmt.Println(time.Now(), "Rejecting message", m.Sequence, "failed:", err)
+		return
 	}
-	fmt.Println(time.Now(), "Order =", ResultOrder)
+	o.ack(m)
+}
 
-	for j := 0; j < len(o.Zakaz.Items); j++ {
-		query = "INSERT INTO item (ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status, orderid)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning ChrtID"
-		err = o.Pool.QueryRow(context.TODO(), query, o.Zakaz.Items[j].ChrtID, o.Zakaz.Items[j].TrackNumber, o.Zakaz.Items[j].Price, o.Zakaz.Items[j].Rid, o.Zakaz.Items[j].Name, o.Zakaz.Items[j].Sale, o.Zakaz.Items[j].Size, o.Zakaz.Items[j].TotalPrice, o.Zakaz.Items[j].NmID, o.Zakaz.Items[j].Brand, o.Zakaz.Items[j].Status, o.Zakaz.OrderUID).Scan(&ResultItems)
-		if err != nil {
-			fmt.Println(time.Now(), "Insert to Items failed:", err)
-		}
-		fmt.Println(time.Now(), "item =", ResultItems)
+// ack подтверждает сообщение, ошибка только логируется: сервер доставит сообщение повторно.
+func (o *Skz) ack(m *stan.Msg) {
+	ackMsg := o.ackMsg
+	if ackMsg == nil {
+		ackMsg = (*stan.Msg).Ack
+	}
+	err := ackMsg(m)
+	if err != nil {
+		fmt.Println(time.Now(), "Ack of message", m.Sequence, "failed:", err)
 	}
 }
 
@@ -479,21 +886,29 @@ func (o *Skz) OrderHandler(Writer http.ResponseWriter, Request *http.Request) {
 		}
 	case "POST":
 		Ouid := Request.PostFormValue("order_uid")
-		Value, found := o.Cash.Get(Ouid)
-		if !found {
+		err = ValidateOrderUID(Ouid)
+		if err != nil {
+			http.Error(Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// При промахе заказ читается из БД, одновременные запросы одного заказа ждут одно чтение
+		Value, cached, err := o.Cash.GetOrLoad(Ouid, orderTTL, o.loadOrder)
+		if errors.Is(err, ErrOrderNotFound) {
+			http.Error(Writer, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(time.Now(), "Something Wrong with reading from DB", err)
+			http.Error(Writer, "reading order failed", http.StatusInternalServerError)
+			return
+		}
+		if !cached {
 			_, err = fmt.Fprintf(Writer, "Reading from DB:\n")
 			fmt.Println(time.Now(), "Reading from DB by request")
 			if err != nil {
 				fmt.Println(time.Now(), "Something wrong with \"fmt.Fprintf\"", err)
 				return
 			}
-			o.Zakaz.OrderUID = Ouid
-			err = o.FromDbToCacheByKey()
-			if err != nil {
-				fmt.Println(time.Now(), "Something Wrong with reading from DB", err)
-				return
-			}
-			Value, _ = o.Cash.Get(o.Zakaz.OrderUID)
 		} else {
 			_, err = fmt.Fprintf(Writer, "Reading from Cache:\n")
 			fmt.Println(time.Now(), "Reading from Cache")
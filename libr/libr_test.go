@@ -0,0 +1,267 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+// ackRecorder подменяет подтверждение сообщений и запоминает подтвержденные номера.
+type ackRecorder struct {
+	sync.Mutex
+	acked map[uint64]int
+}
+
+func (a *ackRecorder) ack(m *stan.Msg) error {
+	a.Lock()
+	defer a.Unlock()
+	a.acked[m.Sequence]++
+	return nil
+}
+
+func (a *ackRecorder) count(seq uint64) int {
+	a.Lock()
+	defer a.Unlock()
+	return a.acked[seq]
+}
+
+// newTestSkz собирает Skz поверх хранилища в памяти с поддельным подтверждением сообщений.
+func newTestSkz() (*Skz, *MemoryRepository, *ackRecorder) {
+	o := NewSkz(Connector{}, time.Minute, 0)
+	repo := NewMemoryRepository()
+	o.Repo = repo
+	acks := &ackRecorder{acked: make(map[uint64]int)}
+	o.ackMsg = acks.ack
+	return o, repo, acks
+}
+
+// fakeMsg сообщение из канала без подписки, его подтверждение идет через Skz.ackMsg.
+func fakeMsg(seq uint64, data []byte) *stan.Msg {
+	return &stan.Msg{MsgProto: pb.MsgProto{Sequence: seq, Subject: "orders", Data: data, Timestamp: time.Now().UnixNano()}}
+}
+
+func mustJSON(t testing.TB, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+/*
+TestConcurrentIngestAndLookups гоняет подписчика и Http запросы одновременно, запускать с -race.
+Каждый заказ приходит созданием и обновлением, пока другие рутины читают его через OrderHandler и APIHandler.
+*/
+func TestConcurrentIngestAndLookups(t *testing.T) {
+	o, repo, acks := newTestSkz()
+	const orders = 50
+	ords := make([]Order, orders)
+	for i := range ords {
+		ords[i] = *NewStrGen()
+	}
+
+	var wg sync.WaitGroup
+	for i := range ords {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ord := ords[i]
+			o.MesageHandler(fakeMsg(uint64(2*i+1), mustJSON(t, ord)))
+			ord.Deliveries.Address = "corrected " + ord.Deliveries.Address
+			o.MesageHandler(fakeMsg(uint64(2*i+2), mustJSON(t, NewUpdateEvent(ord, 2))))
+		}(i)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				uid := ords[(r+n)%orders].OrderUID
+				w := httptest.NewRecorder()
+				if n%2 == 0 {
+					o.APIHandler(w, httptest.NewRequest("GET", "/api/v1/orders/"+uid, nil))
+				} else {
+					req := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"order_uid": {uid}}.Encode()))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					o.OrderHandler(w, req)
+				}
+				if w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+					t.Errorf("lookup of %s: status %d: %s", uid, w.Code, w.Body.String())
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	for i, ord := range ords {
+		for _, seq := range []uint64{uint64(2*i + 1), uint64(2*i + 2)} {
+			if n := acks.count(seq); n != 1 {
+				t.Errorf("message %d acked %d times", seq, n)
+			}
+		}
+		stored, err := repo.GetByUID(context.TODO(), ord.OrderUID)
+		if err != nil {
+			t.Fatalf("order %s is not stored: %v", ord.OrderUID, err)
+		}
+		if stored.Version != 2 {
+			t.Errorf("order %s stored with version %d", ord.OrderUID, stored.Version)
+		}
+		cached, ok := o.Cash.Get(ord.OrderUID)
+		if !ok || cached.Version != 2 {
+			t.Errorf("order %s in cache: found %v, version %d", ord.OrderUID, ok, cached.Version)
+		}
+	}
+}
+
+func TestMesageHandlerDuplicate(t *testing.T) {
+	o, _, acks := newTestSkz()
+	ord := NewStrGen()
+	data := mustJSON(t, ord)
+	o.MesageHandler(fakeMsg(1, data))
+	o.MesageHandler(fakeMsg(1, data))
+	if n := acks.count(1); n != 2 {
+		t.Fatalf("redelivered create must be acked again, acked %d times", n)
+	}
+	if _, ok := o.Cash.Get(ord.OrderUID); !ok {
+		t.Fatal("order is not in cache")
+	}
+}
+
+func TestAPIHandlerStatus(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	ord := NewStrGen()
+	if err := repo.Save(context.TODO(), *ord, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path   string
+		status int
+		origin string
+	}{
+		{"/api/v1/orders/" + ord.OrderUID, http.StatusOK, "database"},
+		{"/api/v1/orders/" + ord.OrderUID, http.StatusOK, "cache"},
+		{"/api/v1/orders/missing", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		o.APIHandler(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status || w.Header().Get(CacheOriginHeader) != c.origin {
+			t.Errorf("%s: got %d %q, want %d %q", c.path, w.Code, w.Header().Get(CacheOriginHeader), c.status, c.origin)
+		}
+	}
+}
+
+func TestUpdateBeforeCreateIsRedelivered(t *testing.T) {
+	o, repo, acks := newTestSkz()
+	ord := *NewStrGen()
+	updated := ord
+	updated.Deliveries.Address = "corrected " + ord.Deliveries.Address
+	update := mustJSON(t, NewUpdateEvent(updated, 2))
+
+	// Создание еще не записано (например, ждет повтора после сбоя), обновление не должно потеряться
+	o.MesageHandler(fakeMsg(2, update))
+	if n := acks.count(2); n != 0 {
+		t.Fatalf("update of unknown order acked %d times", n)
+	}
+	o.MesageHandler(fakeMsg(1, mustJSON(t, ord)))
+	o.MesageHandler(fakeMsg(2, update))
+	if n := acks.count(2); n != 1 {
+		t.Fatalf("redelivered update acked %d times", n)
+	}
+	stored, err := repo.GetByUID(context.TODO(), ord.OrderUID)
+	if err != nil || stored.Version != 2 {
+		t.Fatalf("stored order version %d, err %v", stored.Version, err)
+	}
+}
+
+func TestRedeliveredCreateAfterUpdate(t *testing.T) {
+	_, repo, _ := newTestSkz()
+	ord := *NewStrGen()
+	if err := repo.Save(context.TODO(), ord, 1); err != nil {
+		t.Fatal(err)
+	}
+	updated := ord
+	updated.Version = 2
+	updated.Deliveries.Address = "corrected " + ord.Deliveries.Address
+	if err := repo.Update(context.TODO(), updated, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(context.TODO(), ord, 1); !errors.Is(err, ErrOrderDuplicate) {
+		t.Fatalf("redelivered create after update: got %v, want ErrOrderDuplicate", err)
+	}
+	changed := ord
+	changed.Entry = "other"
+	if err := repo.Save(context.TODO(), changed, 3); !errors.Is(err, ErrOrderConflict) {
+		t.Fatalf("different create after update: got %v, want ErrOrderConflict", err)
+	}
+}
+
+func TestLookupHandlerMultiValued(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	oldest, older, newer := *NewStrGen(), *NewStrGen(), *NewStrGen()
+	older.CustomerID, newer.CustomerID = oldest.CustomerID, oldest.CustomerID
+	older.DateCreated = newer.DateCreated.Add(-time.Hour)
+	oldest.DateCreated = newer.DateCreated.Add(-2 * time.Hour)
+	for _, ord := range []Order{oldest, older, newer} {
+		if err := repo.Save(context.TODO(), ord, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// В кэше два заказа покупателя из трех
+	o.Cash.Set(oldest.OrderUID, oldest, time.Minute)
+	o.Cash.Set(newer.OrderUID, newer, time.Minute)
+
+	lookup := func(query string) (OrderPage, string) {
+		w := httptest.NewRecorder()
+		o.LookupHandler(w, httptest.NewRequest("GET", "/api/v1/lookup?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("lookup %s: got %d: %s", query, w.Code, w.Body.String())
+		}
+		var page OrderPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page, w.Header().Get(CacheOriginHeader)
+	}
+	uids := func(page OrderPage) []string {
+		list := make([]string, 0, len(page.Orders))
+		for _, ord := range page.Orders {
+			list = append(list, ord.OrderUID)
+		}
+		return list
+	}
+	customer := "customer_id=" + url.QueryEscape(oldest.CustomerID)
+
+	page, origin := lookup(customer)
+	if origin != "cache" || !page.Partial || strings.Join(uids(page), ",") != newer.OrderUID+","+oldest.OrderUID {
+		t.Fatalf("cached lookup: origin %q, partial %v, orders %v", origin, page.Partial, uids(page))
+	}
+	page, origin = lookup(customer + "&complete=true")
+	if origin != "database" || page.Partial || strings.Join(uids(page), ",") != newer.OrderUID+","+older.OrderUID+","+oldest.OrderUID {
+		t.Fatalf("complete lookup: origin %q, partial %v, orders %v", origin, page.Partial, uids(page))
+	}
+	// Найденное в БД попало в кэш, и теперь ответ из кэша полный
+	page, origin = lookup("rid=" + url.QueryEscape(older.Items[0].Rid))
+	if origin != "cache" || len(page.Orders) != 1 || page.Orders[0].OrderUID != older.OrderUID {
+		t.Fatalf("rid lookup: origin %q, orders %v", origin, uids(page))
+	}
+}
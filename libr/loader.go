@@ -0,0 +1,105 @@
+package libr
+
+import (
+	"errors"
+	"time"
+)
+
+// errLoadAborted получают ждущие загрузки, если загрузчик упал с паникой.
+var errLoadAborted = errors.New("cache loader aborted")
+
+/*
+loadCall загрузка значения, которую ждут все одновременные GetOrLoad по одному ключу.
+invalidated выставляют Delete и Replace, если ключ поменялся во время загрузки:
+загруженное значение может быть старым, и класть его в кэш нельзя.
+*/
+type loadCall[V any] struct {
+	done        chan struct{}
+	value       V
+	err         error
+	invalidated bool
+}
+
+// negativeItem запомненная ошибка загрузки, например, что заказа нет.
+type negativeItem struct {
+	err        error
+	expiration int64
+}
+
+/*
+GetOrLoad возвращает значение из кэша, а при промахе загружает его через loader и кладет в кэш
+на время duration (0 значит время по умолчанию, как в Set). Одновременные вызовы с одним ключом ждут одну загрузку, так что в хранилище
+уходит один запрос. Ошибки, которые отбирает IsNegative, запоминаются на NegativeTTL и возвращаются
+без вызова loader. cached сообщает, что значение взято из кэша, а не загружено этим вызовом или соседним.
+*/
+func (c *Cache[K, V]) GetOrLoad(key K, duration time.Duration, loader func(key K) (V, error)) (value V, cached bool, err error) {
+	if value, ok := c.Get(key); ok {
+		return value, true, nil
+	}
+	c.Lock()
+	// Пока брали блокировку, значение могли уже загрузить
+	if item, ok := c.items[key]; ok && (item.Expiration == 0 || time.Now().UnixNano() <= item.Expiration) {
+		c.Unlock()
+		return item.Value, true, nil
+	}
+	if neg, ok := c.negative[key]; ok {
+		if time.Now().UnixNano() <= neg.expiration {
+			c.Unlock()
+			return value, false, neg.err
+		}
+		delete(c.negative, key)
+	}
+	if call, ok := c.loads[key]; ok {
+		c.Unlock()
+		<-call.done
+		return call.value, false, call.err
+	}
+	call := &loadCall[V]{done: make(chan struct{}), err: errLoadAborted}
+	c.loads[key] = call
+	c.Unlock()
+
+	defer c.finishLoad(key, call, duration)
+	call.value, call.err = loader(key)
+	return call.value, false, call.err
+}
+
+// finishLoad кладет результат загрузки в кэш и будит ждущих, вызывается и при панике в загрузчике.
+func (c *Cache[K, V]) finishLoad(key K, call *loadCall[V], duration time.Duration) {
+	defer c.notifyRemoved()
+	c.Lock()
+	defer c.Unlock()
+	delete(c.loads, key)
+	close(call.done)
+	if call.invalidated {
+		return
+	}
+	if call.err == nil {
+		// Set во время загрузки важнее: там может быть более новая версия
+		if item, ok := c.items[key]; !ok || (item.Expiration > 0 && time.Now().UnixNano() > item.Expiration) {
+			c.setLocked(key, call.value, duration)
+		}
+		return
+	}
+	if c.negativeTTL > 0 && c.isNegative != nil && c.isNegative(call.err) {
+		c.negative[key] = negativeItem{err: call.err, expiration: time.Now().Add(c.negativeTTL).UnixNano()}
+	}
+}
+
+// invalidateLoadLocked помечает идущую загрузку ключа устаревшей, вызывается под блокировкой.
+func (c *Cache[K, V]) invalidateLoadLocked(key K) {
+	if call, ok := c.loads[key]; ok {
+		call.invalidated = true
+	}
+}
+
+// clearNegative убирает устаревшие запомненные ошибки загрузки.
+func (c *Cache[K, V]) clearNegative() {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now().UnixNano()
+	for k, neg := range c.negative {
+		if now > neg.expiration {
+			delete(c.negative, k)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package libr
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeleteDuringLoad(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		invalidate func(c *Cache[string, int])
+		want       int
+		found      bool
+	}{
+		{"delete", func(c *Cache[string, int]) { c.Delete("k") }, 0, false},
+		{"replace", func(c *Cache[string, int]) { c.Replace("k", 2, 0) }, 2, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cache := NewCatch[string, int](time.Minute, 0)
+			started, release := make(chan struct{}), make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cache.GetOrLoad("k", 0, func(string) (int, error) {
+					close(started)
+					<-release
+					return 1, nil
+				})
+			}()
+			<-started
+			// Инвалидация от другой копии сервиса пришла, пока загрузчик читает старую версию
+			c.invalidate(cache)
+			close(release)
+			<-done
+			v, ok := cache.Get("k")
+			if ok != c.found || v != c.want {
+				t.Fatalf("after load got %d, %v; want %d, %v", v, ok, c.want, c.found)
+			}
+		})
+	}
+}
+
+func TestGetOrLoadCollapses(t *testing.T) {
+	cache := NewCatch[string, int](time.Minute, 0)
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	loader := func(string) (int, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return 1, nil
+	}
+	var wg sync.WaitGroup
+	results := make(chan int, 20)
+	load := func() {
+		defer wg.Done()
+		v, _, err := cache.GetOrLoad("k", 0, loader)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- v
+	}
+	wg.Add(1)
+	go load()
+	<-started
+	for i := 1; i < cap(results); i++ {
+		wg.Add(1)
+		go load()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+	for v := range results {
+		if v != 1 {
+			t.Errorf("got %d, want 1", v)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+	if v, cached, _ := cache.GetOrLoad("k", 0, loader); v != 1 || !cached {
+		t.Fatalf("after load got %d, cached %v", v, cached)
+	}
+}
+
+func TestGetOrLoadTTL(t *testing.T) {
+	cache := NewCatch[string, int](time.Minute, 0)
+	cache.GetOrLoad("k", orderTTL, func(string) (int, error) { return 1, nil })
+	left := time.Until(time.Unix(0, cache.items["k"].Expiration))
+	if left <= time.Minute || left > orderTTL {
+		t.Fatalf("loaded value expires in %v, want %v", left, orderTTL)
+	}
+}
+
+func TestGetOrLoadNegative(t *testing.T) {
+	errOther := errors.New("connection refused")
+	cache := NewCacheWithOptions(CacheOptions[string, int]{
+		DefaultExpiration: time.Minute,
+		NegativeTTL:       50 * time.Millisecond,
+		IsNegative:        func(err error) bool { return errors.Is(err, ErrOrderNotFound) },
+	})
+	calls := 0
+	loadErr := ErrOrderNotFound
+	loader := func(string) (int, error) {
+		calls++
+		return 0, loadErr
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := cache.GetOrLoad("k", 0, loader); err != ErrOrderNotFound {
+			t.Fatalf("got %v, want ErrOrderNotFound", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("missing key loaded %d times within NegativeTTL, want 1", calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	cache.GetOrLoad("k", 0, loader)
+	if calls != 2 {
+		t.Fatalf("missing key loaded %d times after NegativeTTL, want 2", calls)
+	}
+
+	// Ошибки, которые IsNegative не отбирает, не запоминаются
+	loadErr = errOther
+	cache.GetOrLoad("other", 0, loader)
+	cache.GetOrLoad("other", 0, loader)
+	if calls != 4 {
+		t.Fatalf("loader called %d times, want 4: other errors must not be cached", calls)
+	}
+}
+
+func TestGetOrLoadPanicReleasesWaiters(t *testing.T) {
+	cache := NewCatch[string, int](time.Minute, 0)
+	started, release := make(chan struct{}), make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		cache.GetOrLoad("k", 0, func(string) (int, error) {
+			close(started)
+			<-release
+			panic("loader failed")
+		})
+	}()
+	<-started
+	waiter := make(chan error)
+	go func() {
+		_, _, err := cache.GetOrLoad("k", 0, func(string) (int, error) { return 2, nil })
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if r := <-panicked; r == nil {
+		t.Fatal("panic of loader was swallowed")
+	}
+	select {
+	case err := <-waiter:
+		// Ждущий мог прийти и после паники, тогда он сам загрузил значение
+		if err != nil && err != errLoadAborted {
+			t.Fatalf("waiter got %v, want errLoadAborted", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter is stuck after loader panic")
+	}
+	if v, _, err := cache.GetOrLoad("k", 0, func(string) (int, error) { return 3, nil }); err != nil || v == 0 {
+		t.Fatalf("load after panic: %d, %v", v, err)
+	}
+}
@@ -0,0 +1,250 @@
+package libr
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+/*
+Миграции схемы лежат в каталоге migrations и вшиваются в бинарник.
+Имя файла: <версия>_<название>.up.sql и <версия>_<название>.down.sql, версии идут по порядку с 1.
+*/
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew версия схемы в БД новее, чем известно этой сборке.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build knows")
+
+// migrationLock ключ advisory lock, чтобы два экземпляра сервиса не накатывали миграции одновременно.
+const migrationLock = 20220301
+
+// Migration одна версия схемы с запросами для наката и отката.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations читает вшитые миграции и возвращает их по возрастанию версии.
+func Migrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql suffix", base)
+		}
+		name := strings.TrimSuffix(base, "."+direction+".sql")
+		sep := strings.Index(name, "_")
+		if sep < 0 {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>", base)
+		}
+		version, err := strconv.Atoi(name[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", base, err)
+		}
+		body, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name[sep+1:]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i, m := range list {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must go in order from 1, got %d at position %d", m.Version, i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+	}
+	return list, nil
+}
+
+// ensureVersionTable создает таблицу schema_migrations, если ее еще нет.
+func ensureVersionTable(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+		(
+			version    integer primary key,
+			name       varchar(100),
+			applied_at timestamp not null
+		)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// currentVersion возвращает последнюю примененную версию, 0 если миграций еще не было.
+func currentVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow(ctx, "select coalesce(max(version), 0) from schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("select from schema_migrations: %w", err)
+	}
+	return version, nil
+}
+
+/*
+migrateStep в одной транзакции под advisory lock смотрит текущую версию и вызывает step.
+step возвращает false, если делать больше нечего.
+*/
+func migrateStep(ctx context.Context, pool *pgxpool.Pool, step func(tx pgx.Tx, version int) (bool, error)) (bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "select pg_advisory_xact_lock($1)", migrationLock)
+	if err != nil {
+		return false, fmt.Errorf("taking migration lock: %w", err)
+	}
+	err = ensureVersionTable(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	version, err := currentVersion(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	more, err := step(tx, version)
+	if err != nil || !more {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// SchemaVersion возвращает версию схемы в БД.
+func SchemaVersion(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var version int
+	_, err := migrateStep(ctx, pool, func(tx pgx.Tx, v int) (bool, error) {
+		version = v
+		return false, nil
+	})
+	return version, err
+}
+
+/*
+MigrateUp накатывает все еще не примененные миграции, каждую в своей транзакции.
+Если в БД схема новее, чем известно сборке, ничего не делает и возвращает ErrSchemaTooNew.
+*/
+func MigrateUp(ctx context.Context, pool *pgxpool.Pool) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	for {
+		more, err := migrateStep(ctx, pool, func(tx pgx.Tx, version int) (bool, error) {
+			if version > len(migrations) {
+				return false, fmt.Errorf("%w: database has version %d, latest known is %d", ErrSchemaTooNew, version, len(migrations))
+			}
+			if version == len(migrations) {
+				return false, nil
+			}
+			m := migrations[version]
+			_, err := tx.Exec(ctx, m.Up)
+			if err != nil {
+				return false, fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+			}
+			_, err = tx.Exec(ctx, "insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)", m.Version, m.Name, time.Now())
+			if err != nil {
+				return false, fmt.Errorf("insert to schema_migrations: %w", err)
+			}
+			fmt.Println(time.Now(), "Migration", m.Version, m.Name, "applied")
+			return true, nil
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// MigrateDown откатывает steps последних миграций, каждую в своей транзакции.
+func MigrateDown(ctx context.Context, pool *pgxpool.Pool, steps int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	for ; steps > 0; steps-- {
+		more, err := migrateStep(ctx, pool, func(tx pgx.Tx, version int) (bool, error) {
+			if version > len(migrations) {
+				return false, fmt.Errorf("%w: database has version %d, latest known is %d", ErrSchemaTooNew, version, len(migrations))
+			}
+			if version == 0 {
+				return false, nil
+			}
+			m := migrations[version-1]
+			_, err := tx.Exec(ctx, m.Down)
+			if err != nil {
+				return false, fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+			}
+			_, err = tx.Exec(ctx, "delete from schema_migrations where version = $1", m.Version)
+			if err != nil {
+				return false, fmt.Errorf("delete from schema_migrations: %w", err)
+			}
+			fmt.Println(time.Now(), "Migration", m.Version, m.Name, "rolled back")
+			return true, nil
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+CheckSchema проверяет, что схема в БД совпадает с последней миграцией сборки.
+Используется, когда автоматический накат при запуске выключен.
+*/
+func CheckSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: database has version %d, latest known is %d", ErrSchemaTooNew, version, len(migrations))
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("database schema version %d is behind %d, run migrate up", version, len(migrations))
+	}
+	return nil
+}
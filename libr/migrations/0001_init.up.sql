@@ -1,4 +1,6 @@
-CREATE TABLE delivery
+-- Начальная схема, раньше лежала в файле "sql requests" и создавалась вручную.
+-- IF NOT EXISTS, чтобы миграция прошла и на базе, созданной по старому скрипту.
+CREATE TABLE IF NOT EXISTS delivery
   (
       del_id      uuid primary key default gen_random_uuid(),
       del_name    VARCHAR(50),
@@ -10,7 +12,7 @@ CREATE TABLE delivery
       Email   VARCHAR (50)
   );
 
-CREATE TABLE payment
+CREATE TABLE IF NOT EXISTS payment
 (
     pay_id uuid primary key default gen_random_uuid(),
     Transaction VARCHAR (50),
@@ -25,7 +27,7 @@ CREATE TABLE payment
     CustomFee bigint
 );
 
-CREATE TABLE  item
+CREATE TABLE IF NOT EXISTS item
 (
     ChrtID BIGINT NOT NULL primary key,
     TrackNumber VARCHAR (50),
@@ -42,7 +44,7 @@ CREATE TABLE  item
 );
 
 
-CREATE TABLE orders
+CREATE TABLE IF NOT EXISTS orders
 (
     OrderUID VARCHAR(50) not null PRIMARY KEY ,
     TrackNumber varchar(50),
@@ -63,3 +65,14 @@ CREATE TABLE orders
     DateCreated timestamp,
     OofShard varchar(50)
 );
+
+CREATE TABLE IF NOT EXISTS rejected_messages
+(
+    id          bigserial primary key,
+    subject     varchar(100),
+    data        bytea,
+    reason      text,
+    sequence    bigint,
+    rejected_at timestamp,
+    resubmitted boolean not null default false
+);
@@ -0,0 +1,30 @@
+ALTER TABLE orders ADD COLUMN Items bigint[];
+
+UPDATE orders o
+SET Items = (SELECT array_agg(i.ChrtID ORDER BY i.LineNo) FROM item i WHERE i.OrderUID = o.OrderUID);
+
+ALTER TABLE item RENAME TO item_new;
+
+CREATE TABLE item
+(
+    ChrtID BIGINT NOT NULL primary key,
+    TrackNumber VARCHAR (50),
+    Price BIGINT,
+    Rid VARCHAR (50),
+    Item_name VARCHAR (50),
+    Sale bigint,
+    Size VARCHAR (50),
+    TotalPrice bigint,
+    NmID bigint,
+    Brand VARCHAR (50),
+    Status bigint,
+    orderid VARCHAR (50)
+);
+
+-- В старой схеме товар с одним ChrtID может быть только один, остается первый по заказу
+INSERT INTO item (ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status, orderid)
+SELECT DISTINCT ON (ChrtID) ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status, OrderUID
+FROM item_new
+ORDER BY ChrtID, OrderUID, LineNo;
+
+DROP TABLE item_new;
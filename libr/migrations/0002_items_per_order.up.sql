@@ -0,0 +1,32 @@
+-- Товары хранятся отдельно для каждого заказа: ключ номер заказа + номер строки.
+-- Раньше ключом был ChrtID, и два заказа с одним товаром не могли сохраниться.
+ALTER TABLE item RENAME TO item_old;
+
+CREATE TABLE item
+(
+    OrderUID VARCHAR(50) NOT NULL
+        references orders (OrderUID) on delete cascade,
+    LineNo integer NOT NULL,
+    ChrtID BIGINT NOT NULL,
+    TrackNumber VARCHAR (50),
+    Price BIGINT,
+    Rid VARCHAR (50),
+    Item_name VARCHAR (50),
+    Sale bigint,
+    Size VARCHAR (50),
+    TotalPrice bigint,
+    NmID bigint,
+    Brand VARCHAR (50),
+    Status bigint,
+    primary key (OrderUID, LineNo)
+);
+
+INSERT INTO item (OrderUID, LineNo, ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status)
+SELECT o.OrderUID, x.line_no, i.ChrtID, i.TrackNumber, i.Price, i.Rid, i.Item_name, i.Sale, i.Size, i.TotalPrice, i.NmID, i.Brand, i.Status
+FROM orders o
+    CROSS JOIN LATERAL unnest(o.Items) WITH ORDINALITY AS x(chrt_id, line_no)
+    JOIN item_old i ON i.ChrtID = x.chrt_id;
+
+DROP TABLE item_old;
+
+ALTER TABLE orders DROP COLUMN Items;
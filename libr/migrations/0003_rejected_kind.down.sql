@@ -0,0 +1 @@
+ALTER TABLE rejected_messages DROP COLUMN kind;
@@ -0,0 +1,2 @@
+-- Вид отказа, чтобы конфликтующие заказы можно было разбирать отдельно от неразобранных сообщений.
+ALTER TABLE rejected_messages ADD COLUMN kind varchar(20) not null default 'invalid';
@@ -0,0 +1,2 @@
+-- Версия заказа для обновлений с оптимистичной блокировкой, все уже сохраненные заказы получают версию 1.
+ALTER TABLE orders ADD COLUMN version integer not null default 1;
@@ -0,0 +1,16 @@
+-- История изменений заказа: снимок после каждого создания и обновления,
+-- номер сообщения в канале и список измененных полей относительно предыдущей версии.
+CREATE TABLE order_history
+(
+    id         bigserial primary key,
+    OrderUID   VARCHAR(50) NOT NULL
+        references orders (OrderUID) on delete cascade,
+    version    integer     NOT NULL,
+    change     varchar(10) NOT NULL,
+    snapshot   jsonb       NOT NULL,
+    diff       jsonb       NOT NULL,
+    sequence   bigint,
+    changed_at timestamp   NOT NULL
+);
+
+CREATE INDEX order_history_order_idx ON order_history (OrderUID, id);
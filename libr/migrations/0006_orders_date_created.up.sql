@@ -0,0 +1,2 @@
+-- Индекс для прогрева кэша самыми свежими заказами.
+CREATE INDEX orders_date_created_idx ON orders (DateCreated);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS payment_currency_provider_idx;
+DROP INDEX IF EXISTS orders_delivery_service_idx;
+DROP INDEX IF EXISTS orders_track_number_idx;
+DROP INDEX IF EXISTS orders_customer_idx;
+DROP INDEX IF EXISTS orders_created_uid_idx;
+CREATE INDEX orders_date_created_idx ON orders (DateCreated);
@@ -0,0 +1,8 @@
+-- Индексы для выборки заказов с фильтрами и курсором: GET /api/v1/orders.
+-- Курсор идет по паре (DateCreated, OrderUID), поэтому индекс по одной дате больше не нужен.
+DROP INDEX IF EXISTS orders_date_created_idx;
+CREATE INDEX orders_created_uid_idx ON orders (DateCreated, OrderUID);
+CREATE INDEX orders_customer_idx ON orders (CustomerID, DateCreated);
+CREATE INDEX orders_track_number_idx ON orders (TrackNumber);
+CREATE INDEX orders_delivery_service_idx ON orders (DeliveryService, DateCreated);
+CREATE INDEX payment_currency_provider_idx ON payment (Currency, Provider);
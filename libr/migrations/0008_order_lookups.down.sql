@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS item_rid_idx;
+DROP INDEX IF EXISTS payment_transaction_idx;
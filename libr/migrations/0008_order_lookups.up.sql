@@ -0,0 +1,3 @@
+-- Индексы для поиска заказа по транзакции платежа и по rid товара.
+CREATE INDEX payment_transaction_idx ON payment (Transaction);
+CREATE INDEX item_rid_idx ON item (Rid);
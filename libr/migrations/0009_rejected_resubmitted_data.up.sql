@@ -0,0 +1,2 @@
+-- Исправленный вариант, отправленный повторно, хранится отдельно, исходные байты в data не меняются.
+ALTER TABLE rejected_messages ADD COLUMN resubmitted_data bytea;
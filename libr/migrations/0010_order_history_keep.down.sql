@@ -0,0 +1,3 @@
+DELETE FROM order_history h WHERE NOT EXISTS (SELECT 1 FROM orders o WHERE o.OrderUID = h.OrderUID);
+ALTER TABLE order_history ADD CONSTRAINT order_history_orderuid_fkey
+    FOREIGN KEY (OrderUID) REFERENCES orders (OrderUID) ON DELETE CASCADE;
@@ -0,0 +1,2 @@
+-- История заказа остается после его удаления, удаление записывается в нее отдельной записью.
+ALTER TABLE order_history DROP CONSTRAINT order_history_orderuid_fkey;
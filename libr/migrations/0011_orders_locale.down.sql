@@ -0,0 +1 @@
+DROP INDEX IF EXISTS orders_locale_idx;
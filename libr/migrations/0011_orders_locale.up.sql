@@ -0,0 +1,2 @@
+-- Индекс для фильтра locale в GET /api/v1/orders.
+CREATE INDEX orders_locale_idx ON orders (Locale, DateCreated);
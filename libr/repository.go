@@ -0,0 +1,710 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	// ErrOrderDuplicate заказ с таким номером и тем же содержимым уже сохранен, например при повторной доставке.
+	ErrOrderDuplicate = errors.New("order already saved with the same content")
+	// ErrOrderConflict заказ с таким номером уже сохранен, но содержимое отличается.
+	ErrOrderConflict = errors.New("order already saved with different content")
+	// ErrStaleVersion обновление с версией не новее сохраненной.
+	ErrStaleVersion = errors.New("order version is stale")
+	// ErrVersionGap обновление пришло раньше предыдущих версий, его нужно повторить позже.
+	ErrVersionGap = errors.New("order version skips previous versions")
+)
+
+// uniqueViolation код ошибки Postgres при нарушении уникальности.
+const uniqueViolation = "23505"
+
+/*
+OrderRepository хранилище заказов и отклоненных сообщений. Skz работает с ними только через него,
+поэтому Postgres можно заменить, например, на MemoryRepository в тестах.
+*/
+type OrderRepository interface {
+	RejectedStore
+	/*
+		Save сохраняет новый заказ и запись истории с номером сообщения seq. Если такой номер уже есть, ничего не пишет и возвращает
+		ErrOrderDuplicate для того же содержимого или ErrOrderConflict, если содержимое другое.
+		Если сохранена уже более новая версия, заказ сверяется со снимком своей версии из истории.
+	*/
+	Save(ctx context.Context, order Order, seq uint64) error
+	/*
+		Update заменяет сохраненный заказ новой версией order.Version, которая должна быть ровно на 1 больше сохраненной.
+		Для старой версии возвращает ErrStaleVersion, при пропуске версий ErrVersionGap,
+		для повтора уже примененного обновления ErrOrderDuplicate, для неизвестного заказа ErrOrderNotFound.
+	*/
+	Update(ctx context.Context, order Order, seq uint64) error
+	// GetByUID возвращает заказ по номеру или ErrOrderNotFound.
+	GetByUID(ctx context.Context, uid string) (Order, error)
+	// List возвращает заказы, подходящие под filter, от новых к старым (см. OrderFilter).
+	List(ctx context.Context, filter OrderFilter) ([]Order, error)
+	/*
+		Recent вызывает fn для limit самых свежих по DateCreated заказов, созданных не раньше since
+		(нулевое since и limit <= 0 снимают ограничения). Заказы идут от старых к новым,
+		чтобы при переполнении кэша вытеснялись более старые. Ошибка fn прерывает обход.
+	*/
+	Recent(ctx context.Context, since time.Time, limit int, fn func(Order) error) error
+	// Delete удаляет заказ со всеми связанными данными, кроме истории, куда дописывается удаление, или возвращает ErrOrderNotFound.
+	Delete(ctx context.Context, uid string) error
+	// Exists проверяет, есть ли заказ с таким номером.
+	Exists(ctx context.Context, uid string) (bool, error)
+	// History возвращает историю изменений заказа или ErrOrderNotFound.
+	History(ctx context.Context, uid string) ([]OrderHistoryEntry, error)
+}
+
+/*
+OrderFilter условия выборки заказов в List. Пустые поля не ограничивают выборку,
+CreatedFrom включается, CreatedTo нет. Заказы идут от новых к старым по DateCreated, затем по OrderUID,
+After продолжает выборку после этой позиции (курсор), Limit <= 0 значит без ограничения.
+*/
+type OrderFilter struct {
+	CustomerID      string
+	TrackNumber     string
+	DeliveryService string
+	Locale          string
+	Currency        string
+	Provider        string
+	Transaction     string
+	Rid             string
+	CreatedFrom     time.Time
+	CreatedTo       time.Time
+	After           *OrderCursor
+	Limit           int
+}
+
+// OrderCursor позиция в выборке List: последний отданный заказ.
+type OrderCursor struct {
+	DateCreated time.Time `json:"date_created"`
+	OrderUID    string    `json:"order_uid"`
+}
+
+// Match проверяет заказ на условия фильтра, кроме курсора и лимита.
+func (f OrderFilter) Match(ord Order) bool {
+	switch {
+	case f.CustomerID != "" && ord.CustomerID != f.CustomerID,
+		f.TrackNumber != "" && ord.TrackNumber != f.TrackNumber,
+		f.DeliveryService != "" && ord.DeliveryService != f.DeliveryService,
+		f.Locale != "" && ord.Locale != f.Locale,
+		f.Currency != "" && ord.Pays.Currency != f.Currency,
+		f.Provider != "" && ord.Pays.Provider != f.Provider,
+		f.Transaction != "" && ord.Pays.Transaction != f.Transaction,
+		f.Rid != "" && !hasRid(ord, f.Rid),
+		!f.CreatedFrom.IsZero() && ord.DateCreated.Before(f.CreatedFrom),
+		!f.CreatedTo.IsZero() && !ord.DateCreated.Before(f.CreatedTo):
+		return false
+	}
+	return true
+}
+
+// hasRid проверяет, есть ли в заказе товар с таким rid.
+func hasRid(ord Order, rid string) bool {
+	for _, item := range ord.Items {
+		if item.Rid == rid {
+			return true
+		}
+	}
+	return false
+}
+
+// before проверяет, что заказ идет в выборке после курсора.
+func (c OrderCursor) before(ord Order) bool {
+	if ord.DateCreated.Equal(c.DateCreated) {
+		return ord.OrderUID < c.OrderUID
+	}
+	return ord.DateCreated.Before(c.DateCreated)
+}
+
+// sortNewestFirst упорядочивает заказы как List: от новых к старым по DateCreated, затем по OrderUID.
+func sortNewestFirst(list []Order) {
+	sort.Slice(list, func(i, j int) bool {
+		return OrderCursor{DateCreated: list[i].DateCreated, OrderUID: list[i].OrderUID}.before(list[j])
+	})
+}
+
+// PgRepository хранилище заказов в Postgres.
+type PgRepository struct {
+	Pool *pgxpool.Pool
+}
+
+// NewPgRepository создает хранилище поверх пула подключений.
+func NewPgRepository(pool *pgxpool.Pool) *PgRepository {
+	return &PgRepository{Pool: pool}
+}
+
+/*
+Save записывает заказ в БД одной транзакцией: доставка, платеж, заказ и товары.
+При ошибке на любом шаге транзакция откатывается, и в таблицах не остается "висящих" строк.
+Перед записью номер заказа блокируется и сравнивается с уже сохраненным, так повторная доставка ничего не портит.
+*/
+func (r *PgRepository) Save(ctx context.Context, order Order, seq uint64) error {
+	var ResultDelivery, ResultPayment, ResultOrder string
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	// После успешного Commit откат ничего не делает
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "select pg_advisory_xact_lock(hashtext($1))", order.OrderUID)
+	if err != nil {
+		return fmt.Errorf("lock order %s: %w", order.OrderUID, err)
+	}
+	existing, err := scanOrder(tx.QueryRow(ctx, selectOrder+" where o.OrderUID = $1", order.OrderUID))
+	if err == nil {
+		var snapshot *Order
+		if orderVersion(order) < existing.Version {
+			snapshot, err = historySnapshot(ctx, tx, order.OrderUID, orderVersion(order))
+			if err != nil {
+				return err
+			}
+		}
+		return compareExisting(existing, snapshot, order)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("select order %s: %w", order.OrderUID, err)
+	}
+
+	query := "INSERT INTO delivery (del_name, Phone, Zip, City, Address, Region, Email)	Values ($1, $2, $3, $4, $5, $6, $7) returning del_id"
+	err = tx.QueryRow(ctx, query, order.Deliveries.Name, order.Deliveries.Phone, order.Deliveries.Zip, order.Deliveries.City, order.Deliveries.Address, order.Deliveries.Region, order.Deliveries.Email).Scan(&ResultDelivery)
+	if err != nil {
+		return fmt.Errorf("insert to delivery: %w", err)
+	}
+	fmt.Println(time.Now(), "delivery =", ResultDelivery)
+
+	query = "INSERT INTO payment (Transaction, RequestID, Currency, Provider, Amount, PaymentDt, Bank, DeliveryCost, GoodsTotal, CustomFee)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning pay_id"
+	err = tx.QueryRow(ctx, query, order.Pays.Transaction, order.Pays.RequestID, order.Pays.Currency, order.Pays.Provider, order.Pays.Amount, order.Pays.PaymentDt, order.Pays.Bank, order.Pays.DeliveryCost, order.Pays.GoodsTotal, order.Pays.CustomFee).Scan(&ResultPayment)
+	if err != nil {
+		return fmt.Errorf("insert to payment: %w", err)
+	}
+	fmt.Println(time.Now(), "payment =", ResultPayment)
+
+	query = "INSERT INTO orders (OrderUID, TrackNumber, Entry, Deliveries, Pays, Locale, InternalSignature, CustomerID, DeliveryService, Shardkey, SmID, DateCreated, OofShard, version)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning OrderUID"
+	err = tx.QueryRow(ctx, query, order.OrderUID, order.TrackNumber, order.Entry, ResultDelivery, ResultPayment, order.Locale, order.InternalSignature, order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard, orderVersion(order)).Scan(&ResultOrder)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return ErrOrderConflict
+		}
+		return fmt.Errorf("insert to orders: %w", err)
+	}
+	fmt.Println(time.Now(), "Order =", ResultOrder)
+
+	err = insertItems(ctx, tx, order)
+	if err != nil {
+		return err
+	}
+	order.Version = orderVersion(order)
+	err = insertHistory(ctx, tx, OrderHistoryEntry{Version: order.Version, Change: ChangeCreate, Snapshot: order, Diff: []FieldChange{}, Sequence: seq, ChangedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// insertItems записывает товары заказа, товары привязаны к заказу номером строки.
+func insertItems(ctx context.Context, tx pgx.Tx, order Order) error {
+	var ResultItems int
+	// Один и тот же ChrtID может быть в разных заказах
+	for j := 0; j < len(order.Items); j++ {
+		query := "INSERT INTO item (OrderUID, LineNo, ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status)	Values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning ChrtID"
+		err := tx.QueryRow(ctx, query, order.OrderUID, j+1, order.Items[j].ChrtID, order.Items[j].TrackNumber, order.Items[j].Price, order.Items[j].Rid, order.Items[j].Name, order.Items[j].Sale, order.Items[j].Size, order.Items[j].TotalPrice, order.Items[j].NmID, order.Items[j].Brand, order.Items[j].Status).Scan(&ResultItems)
+		if err != nil {
+			return fmt.Errorf("insert to item: %w", err)
+		}
+		fmt.Println(time.Now(), "item =", ResultItems)
+	}
+	return nil
+}
+
+/*
+Update применяет новую версию заказа одной транзакцией: доставка и платеж обновляются на месте,
+товары переписываются целиком. Строка заказа обновляется только если в БД все еще предыдущая версия.
+*/
+func (r *PgRepository) Update(ctx context.Context, order Order, seq uint64) error {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "select pg_advisory_xact_lock(hashtext($1))", order.OrderUID)
+	if err != nil {
+		return fmt.Errorf("lock order %s: %w", order.OrderUID, err)
+	}
+	current, err := scanOrder(tx.QueryRow(ctx, selectOrder+" where o.OrderUID = $1", order.OrderUID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrOrderNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("select order %s: %w", order.OrderUID, err)
+	}
+	err = checkUpdateVersion(current, order)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE orders SET TrackNumber = $3, Entry = $4, Locale = $5, InternalSignature = $6, CustomerID = $7, DeliveryService = $8, Shardkey = $9, SmID = $10, DateCreated = $11, OofShard = $12, version = $2 
+		where OrderUID = $1 and version = $2 - 1 
+		returning Deliveries, Pays`
+	var DelId, PayId string
+	err = tx.QueryRow(ctx, query, order.OrderUID, order.Version, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature, order.CustomerID, order.DeliveryService, order.Shardkey, order.SmID, order.DateCreated, order.OofShard).Scan(&DelId, &PayId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Версию успели поменять между проверкой и обновлением
+		return fmt.Errorf("%w: order %s is no longer at version %d", ErrStaleVersion, order.OrderUID, order.Version-1)
+	}
+	if err != nil {
+		return fmt.Errorf("update orders: %w", err)
+	}
+
+	query = "UPDATE delivery SET del_name = $2, Phone = $3, Zip = $4, City = $5, Address = $6, Region = $7, Email = $8 where del_id = $1"
+	_, err = tx.Exec(ctx, query, DelId, order.Deliveries.Name, order.Deliveries.Phone, order.Deliveries.Zip, order.Deliveries.City, order.Deliveries.Address, order.Deliveries.Region, order.Deliveries.Email)
+	if err != nil {
+		return fmt.Errorf("update delivery: %w", err)
+	}
+	query = "UPDATE payment SET Transaction = $2, RequestID = $3, Currency = $4, Provider = $5, Amount = $6, PaymentDt = $7, Bank = $8, DeliveryCost = $9, GoodsTotal = $10, CustomFee = $11 where pay_id = $1"
+	_, err = tx.Exec(ctx, query, PayId, order.Pays.Transaction, order.Pays.RequestID, order.Pays.Currency, order.Pays.Provider, order.Pays.Amount, order.Pays.PaymentDt, order.Pays.Bank, order.Pays.DeliveryCost, order.Pays.GoodsTotal, order.Pays.CustomFee)
+	if err != nil {
+		return fmt.Errorf("update payment: %w", err)
+	}
+	_, err = tx.Exec(ctx, "delete from item where OrderUID = $1", order.OrderUID)
+	if err != nil {
+		return fmt.Errorf("delete from item: %w", err)
+	}
+	err = insertItems(ctx, tx, order)
+	if err != nil {
+		return err
+	}
+	diff, err := DiffOrders(normalizeOrder(current), normalizeOrder(order))
+	if err != nil {
+		return fmt.Errorf("diff of order %s: %w", order.OrderUID, err)
+	}
+	err = insertHistory(ctx, tx, OrderHistoryEntry{Version: order.Version, Change: ChangeUpdate, Snapshot: order, Diff: diff, Sequence: seq, ChangedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	fmt.Println(time.Now(), "Order", order.OrderUID, "updated to version", order.Version)
+	return nil
+}
+
+// selectOrder выбирает заказ вместе с доставкой и платежом, товары собираются в JSON массив.
+const selectOrder = `
+	select o.OrderUID, o.version, o.TrackNumber, o.Entry, o.Locale, o.InternalSignature, o.CustomerID, o.DeliveryService, o.Shardkey, o.SmID, o.DateCreated, o.OofShard,
+		d.del_name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email,
+		p.Transaction, p.RequestID, p.Currency, p.Provider, p.Amount, p.PaymentDt, p.Bank, p.DeliveryCost, p.GoodsTotal, p.CustomFee,
+		coalesce((select json_agg(json_build_object(
+				'chrt_id', i.ChrtID, 'track_number', i.TrackNumber, 'price', i.Price, 'rid', i.Rid, 'name', i.Item_name, 'sale', i.Sale,
+				'size', i.Size, 'total_price', i.TotalPrice, 'nm_id', i.NmID, 'brand', i.Brand, 'status', i.Status)
+				order by i.LineNo)
+			from item i
+			where i.OrderUID = o.OrderUID), '[]')
+	from orders o
+		join delivery d on d.del_id = o.Deliveries
+		join payment p on p.pay_id = o.Pays`
+
+// scanOrder разбирает строку, выбранную запросом selectOrder.
+func scanOrder(row pgx.Row) (Order, error) {
+	var ord Order
+	var items []byte
+	err := row.Scan(&ord.OrderUID, &ord.Version, &ord.TrackNumber, &ord.Entry, &ord.Locale, &ord.InternalSignature, &ord.CustomerID, &ord.DeliveryService, &ord.Shardkey, &ord.SmID, &ord.DateCreated, &ord.OofShard,
+		&ord.Deliveries.Name, &ord.Deliveries.Phone, &ord.Deliveries.Zip, &ord.Deliveries.City, &ord.Deliveries.Address, &ord.Deliveries.Region, &ord.Deliveries.Email,
+		&ord.Pays.Transaction, &ord.Pays.RequestID, &ord.Pays.Currency, &ord.Pays.Provider, &ord.Pays.Amount, &ord.Pays.PaymentDt, &ord.Pays.Bank, &ord.Pays.DeliveryCost, &ord.Pays.GoodsTotal, &ord.Pays.CustomFee,
+		&items)
+	if err != nil {
+		return Order{}, err
+	}
+	err = json.Unmarshal(items, &ord.Items)
+	if err != nil {
+		return Order{}, fmt.Errorf("unmarshal items of order %s: %w", ord.OrderUID, err)
+	}
+	return ord, nil
+}
+
+/*
+GetByUID собирает заказ из таблиц orders, item, delivery и payment одним запросом.
+Номер заказа передается параметром, а не подставляется в текст запроса.
+*/
+func (r *PgRepository) GetByUID(ctx context.Context, uid string) (Order, error) {
+	ord, err := scanOrder(r.Pool.QueryRow(ctx, selectOrder+" where o.OrderUID = $1", uid))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("select order %s: %w", uid, err)
+	}
+	return ord, nil
+}
+
+/*
+List выбирает заказы одним запросом, так же как GetByUID. Значения фильтра передаются параметрами,
+курсор сравнивается по паре (DateCreated, OrderUID), чтобы использовать индекс orders_created_uid_idx.
+*/
+func (r *PgRepository) List(ctx context.Context, filter OrderFilter) ([]Order, error) {
+	var conds []string
+	var args []interface{}
+	// add добавляет условие, заменяя каждый $? номером следующего параметра
+	add := func(cond string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			cond = strings.Replace(cond, "$?", "$"+strconv.Itoa(len(args)), 1)
+		}
+		conds = append(conds, cond)
+	}
+	if filter.CustomerID != "" {
+		add("o.CustomerID = $?", filter.CustomerID)
+	}
+	if filter.TrackNumber != "" {
+		add("o.TrackNumber = $?", filter.TrackNumber)
+	}
+	if filter.DeliveryService != "" {
+		add("o.DeliveryService = $?", filter.DeliveryService)
+	}
+	if filter.Locale != "" {
+		add("o.Locale = $?", filter.Locale)
+	}
+	if filter.Currency != "" {
+		add("p.Currency = $?", filter.Currency)
+	}
+	if filter.Provider != "" {
+		add("p.Provider = $?", filter.Provider)
+	}
+	if filter.Transaction != "" {
+		add("p.Transaction = $?", filter.Transaction)
+	}
+	if filter.Rid != "" {
+		add("exists (select 1 from item i where i.OrderUID = o.OrderUID and i.Rid = $?)", filter.Rid)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		add("o.DateCreated >= $?", filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		add("o.DateCreated < $?", filter.CreatedTo)
+	}
+	if filter.After != nil {
+		add("(o.DateCreated, o.OrderUID) < ($?, $?)", filter.After.DateCreated, filter.After.OrderUID)
+	}
+	query := selectOrder
+	if len(conds) > 0 {
+		query += " where " + strings.Join(conds, " and ")
+	}
+	query += " order by o.DateCreated desc, o.OrderUID desc"
+	if filter.Limit > 0 {
+		query += " limit " + strconv.Itoa(filter.Limit)
+	}
+	rows, err := r.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select from orders: %w", err)
+	}
+	defer rows.Close()
+	list := make([]Order, 0)
+	for rows.Next() {
+		ord, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning order: %w", err)
+		}
+		list = append(list, ord)
+	}
+	return list, rows.Err()
+}
+
+/*
+Recent читает заказы одним запросом и отдает их fn по мере чтения строк,
+поэтому весь список не держится в памяти.
+*/
+func (r *PgRepository) Recent(ctx context.Context, since time.Time, limit int, fn func(Order) error) error {
+	query := "select OrderUID from orders where DateCreated >= $1 order by DateCreated desc"
+	args := []interface{}{since}
+	if limit > 0 {
+		query += " limit $2"
+		args = append(args, limit)
+	}
+	rows, err := r.Pool.Query(ctx, selectOrder+" where o.OrderUID in ("+query+") order by o.DateCreated, o.OrderUID", args...)
+	if err != nil {
+		return fmt.Errorf("select recent orders: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		ord, err := scanOrder(rows)
+		if err != nil {
+			return fmt.Errorf("scanning order: %w", err)
+		}
+		err = fn(ord)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Delete удаляет заказ, доставку и платеж одной транзакцией, товары удаляются каскадно вместе с заказом.
+func (r *PgRepository) Delete(ctx context.Context, uid string) error {
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	// Последняя версия заказа остается в истории вместе с записью об удалении
+	ord, err := scanOrder(tx.QueryRow(ctx, selectOrder+" where o.OrderUID = $1", uid))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrOrderNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("select order %s: %w", uid, err)
+	}
+	err = insertHistory(ctx, tx, OrderHistoryEntry{Version: ord.Version, Change: ChangeDelete, Snapshot: ord, Diff: []FieldChange{}, ChangedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	var DelId, PayId string
+	err = tx.QueryRow(ctx, "delete from orders where orderuid = $1 returning deliveries, pays", uid).Scan(&DelId, &PayId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrOrderNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("delete from orders: %w", err)
+	}
+	_, err = tx.Exec(ctx, "delete from delivery where del_id = $1", DelId)
+	if err != nil {
+		return fmt.Errorf("delete from delivery: %w", err)
+	}
+	_, err = tx.Exec(ctx, "delete from payment where pay_id = $1", PayId)
+	if err != nil {
+		return fmt.Errorf("delete from payment: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+// Exists проверяет наличие заказа в таблице orders.
+func (r *PgRepository) Exists(ctx context.Context, uid string) (bool, error) {
+	var exists bool
+	err := r.Pool.QueryRow(ctx, "select exists(select 1 from orders where orderuid = $1)", uid).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("select from orders: %w", err)
+	}
+	return exists, nil
+}
+
+// orderVersion версия нового заказа, если она не указана, то 1.
+func orderVersion(order Order) int {
+	if order.Version == 0 {
+		return 1
+	}
+	return order.Version
+}
+
+// checkUpdateVersion сверяет версию обновления с сохраненным заказом.
+func checkUpdateVersion(current, order Order) error {
+	switch {
+	case order.Version == current.Version+1:
+		return nil
+	case order.Version > current.Version+1:
+		return fmt.Errorf("%w: order %s has version %d, got %d", ErrVersionGap, order.OrderUID, current.Version, order.Version)
+	case order.Version == current.Version && SameOrder(current, order):
+		return ErrOrderDuplicate
+	}
+	return fmt.Errorf("%w: order %s has version %d, got %d", ErrStaleVersion, order.OrderUID, current.Version, order.Version)
+}
+
+/*
+compareExisting решает, повтор это или конфликт, когда заказ с таким номером уже есть.
+Если уже сохранена более новая версия, повторная доставка создания сверяется со снимком своей версии
+из истории (snapshot); если снимка нет, это устаревшая версия, а не конфликт.
+*/
+func compareExisting(existing Order, snapshot *Order, order Order) error {
+	if version := orderVersion(order); version < existing.Version {
+		if snapshot == nil {
+			return fmt.Errorf("%w: order %s has version %d, got %d", ErrStaleVersion, order.OrderUID, existing.Version, version)
+		}
+		existing = *snapshot
+	}
+	if SameOrder(existing, order) {
+		return ErrOrderDuplicate
+	}
+	return ErrOrderConflict
+}
+
+/*
+SameOrder сравнивает содержимое двух заказов.
+Время создания сравнивается с точностью Postgres: до микросекунд и без часового пояса.
+*/
+func SameOrder(a, b Order) bool {
+	a, b = normalizeOrder(a), normalizeOrder(b)
+	return reflect.DeepEqual(a, b)
+}
+
+// normalizeOrder приводит заказ к виду, в котором он возвращается из БД.
+func normalizeOrder(ord Order) Order {
+	t := ord.DateCreated
+	ord.DateCreated = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).Round(time.Microsecond)
+	if len(ord.Items) == 0 {
+		ord.Items = nil
+	}
+	ord.Version = orderVersion(ord)
+	return ord
+}
+
+/*
+MemoryRepository хранилище заказов в памяти, для тестов и запуска без БД.
+Заказы копируются при записи и чтении, чтобы вызывающий код не мог поменять сохраненные данные.
+*/
+type MemoryRepository struct {
+	sync.RWMutex
+	orders   map[string]Order
+	history  map[string][]OrderHistoryEntry
+	rejected []RejectedMessage
+}
+
+// NewMemoryRepository создает пустое хранилище в памяти.
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{orders: make(map[string]Order), history: make(map[string][]OrderHistoryEntry)}
+}
+
+// copyOrder копирует заказ вместе с массивом товаров.
+func copyOrder(ord Order) Order {
+	if ord.Items != nil {
+		ord.Items = append([]Item(nil), ord.Items...)
+	}
+	return ord
+}
+
+// Save сохраняет копию заказа и запись истории.
+func (r *MemoryRepository) Save(ctx context.Context, order Order, seq uint64) error {
+	r.Lock()
+	defer r.Unlock()
+	if existing, ok := r.orders[order.OrderUID]; ok {
+		var snapshot *Order
+		for _, entry := range r.history[order.OrderUID] {
+			if entry.Version == orderVersion(order) {
+				snapshot = &entry.Snapshot
+				break
+			}
+		}
+		return compareExisting(existing, snapshot, order)
+	}
+	order.Version = orderVersion(order)
+	r.orders[order.OrderUID] = copyOrder(order)
+	r.history[order.OrderUID] = append(r.history[order.OrderUID], OrderHistoryEntry{Version: order.Version, Change: ChangeCreate, Snapshot: copyOrder(order), Diff: []FieldChange{}, Sequence: seq, ChangedAt: time.Now()})
+	return nil
+}
+
+// Update заменяет заказ новой версией и дописывает историю.
+func (r *MemoryRepository) Update(ctx context.Context, order Order, seq uint64) error {
+	r.Lock()
+	defer r.Unlock()
+	current, ok := r.orders[order.OrderUID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	err := checkUpdateVersion(current, order)
+	if err != nil {
+		return err
+	}
+	diff, err := DiffOrders(normalizeOrder(current), normalizeOrder(order))
+	if err != nil {
+		return fmt.Errorf("diff of order %s: %w", order.OrderUID, err)
+	}
+	r.orders[order.OrderUID] = copyOrder(order)
+	r.history[order.OrderUID] = append(r.history[order.OrderUID], OrderHistoryEntry{Version: order.Version, Change: ChangeUpdate, Snapshot: copyOrder(order), Diff: diff, Sequence: seq, ChangedAt: time.Now()})
+	return nil
+}
+
+// GetByUID возвращает копию заказа.
+func (r *MemoryRepository) GetByUID(ctx context.Context, uid string) (Order, error) {
+	r.RLock()
+	defer r.RUnlock()
+	ord, ok := r.orders[uid]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return copyOrder(ord), nil
+}
+
+// List возвращает копии заказов, подходящих под filter, в том же порядке, что и PgRepository.
+func (r *MemoryRepository) List(ctx context.Context, filter OrderFilter) ([]Order, error) {
+	r.RLock()
+	list := make([]Order, 0)
+	for _, ord := range r.orders {
+		if filter.Match(ord) && (filter.After == nil || filter.After.before(ord)) {
+			list = append(list, copyOrder(ord))
+		}
+	}
+	r.RUnlock()
+	sortNewestFirst(list)
+	if filter.Limit > 0 && filter.Limit < len(list) {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
+
+// Recent отдает fn копии самых свежих заказов от старых к новым.
+func (r *MemoryRepository) Recent(ctx context.Context, since time.Time, limit int, fn func(Order) error) error {
+	r.RLock()
+	list := make([]Order, 0, len(r.orders))
+	for _, ord := range r.orders {
+		if !ord.DateCreated.Before(since) {
+			list = append(list, copyOrder(ord))
+		}
+	}
+	r.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].DateCreated.Equal(list[j].DateCreated) {
+			return list[i].OrderUID < list[j].OrderUID
+		}
+		return list[i].DateCreated.Before(list[j].DateCreated)
+	})
+	if limit > 0 && limit < len(list) {
+		list = list[len(list)-limit:]
+	}
+	for _, ord := range list {
+		err := fn(ord)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete удаляет заказ из памяти и дописывает удаление в историю.
+func (r *MemoryRepository) Delete(ctx context.Context, uid string) error {
+	r.Lock()
+	defer r.Unlock()
+	ord, ok := r.orders[uid]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	delete(r.orders, uid)
+	r.history[uid] = append(r.history[uid], OrderHistoryEntry{Version: ord.Version, Change: ChangeDelete, Snapshot: copyOrder(ord), Diff: []FieldChange{}, ChangedAt: time.Now()})
+	return nil
+}
+
+// Exists проверяет наличие заказа в памяти.
+func (r *MemoryRepository) Exists(ctx context.Context, uid string) (bool, error) {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.orders[uid]
+	return ok, nil
+}
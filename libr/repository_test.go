@@ -0,0 +1,122 @@
+package libr
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testDSNEnv переменная окружения со строкой подключения к тестовой БД, без нее тесты с Postgres пропускаются.
+const testDSNEnv = "WBL0_TEST_DSN"
+
+// testPgRepository подключается к тестовой БД и накатывает миграции.
+func testPgRepository(tb testing.TB) *PgRepository {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		tb.Skip(testDSNEnv + " is not set")
+	}
+	pool, err := pgxpool.Connect(context.Background(), dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+	err = MigrateUp(context.Background(), pool)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewPgRepository(pool)
+}
+
+/*
+getByUIDPerRow собирает заказ так, как это делалось до одного запроса с json_agg:
+строка заказа, затем каждый товар, доставка и платеж отдельными запросами.
+Нужен только для сравнения в BenchmarkGetByUID.
+*/
+func getByUIDPerRow(ctx context.Context, r *PgRepository, uid string) (Order, error) {
+	ord := Order{OrderUID: uid}
+	var delID, payID string
+	err := r.Pool.QueryRow(ctx, `select version, TrackNumber, Entry, Deliveries, Pays, Locale, InternalSignature, CustomerID, DeliveryService, Shardkey, SmID, DateCreated, OofShard
+		from orders where OrderUID = $1`, uid).Scan(&ord.Version, &ord.TrackNumber, &ord.Entry, &delID, &payID, &ord.Locale, &ord.InternalSignature, &ord.CustomerID, &ord.DeliveryService, &ord.Shardkey, &ord.SmID, &ord.DateCreated, &ord.OofShard)
+	if err != nil {
+		return Order{}, err
+	}
+	rows, err := r.Pool.Query(ctx, "select LineNo from item where OrderUID = $1 order by LineNo", uid)
+	if err != nil {
+		return Order{}, err
+	}
+	lines := make([]int, 0)
+	for rows.Next() {
+		var line int
+		err = rows.Scan(&line)
+		if err != nil {
+			rows.Close()
+			return Order{}, err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	for _, line := range lines {
+		var it Item
+		err = r.Pool.QueryRow(ctx, `select ChrtID, TrackNumber, Price, Rid, Item_name, Sale, Size, TotalPrice, NmID, Brand, Status
+			from item where OrderUID = $1 and LineNo = $2`, uid, line).Scan(&it.ChrtID, &it.TrackNumber, &it.Price, &it.Rid, &it.Name, &it.Sale, &it.Size, &it.TotalPrice, &it.NmID, &it.Brand, &it.Status)
+		if err != nil {
+			return Order{}, err
+		}
+		ord.Items = append(ord.Items, it)
+	}
+	err = r.Pool.QueryRow(ctx, "select del_name, Phone, Zip, City, Address, Region, Email from delivery where del_id = $1", delID).Scan(
+		&ord.Deliveries.Name, &ord.Deliveries.Phone, &ord.Deliveries.Zip, &ord.Deliveries.City, &ord.Deliveries.Address, &ord.Deliveries.Region, &ord.Deliveries.Email)
+	if err != nil {
+		return Order{}, err
+	}
+	err = r.Pool.QueryRow(ctx, `select Transaction, RequestID, Currency, Provider, Amount, PaymentDt, Bank, DeliveryCost, GoodsTotal, CustomFee
+		from payment where pay_id = $1`, payID).Scan(&ord.Pays.Transaction, &ord.Pays.RequestID, &ord.Pays.Currency, &ord.Pays.Provider, &ord.Pays.Amount, &ord.Pays.PaymentDt, &ord.Pays.Bank, &ord.Pays.DeliveryCost, &ord.Pays.GoodsTotal, &ord.Pays.CustomFee)
+	if err != nil {
+		return Order{}, err
+	}
+	return ord, nil
+}
+
+// BenchmarkGetByUID сравнивает один запрос с json_agg и прежнюю цепочку запросов на каждую строку.
+func BenchmarkGetByUID(b *testing.B) {
+	r := testPgRepository(b)
+	ctx := context.Background()
+	ord := NewStrGen()
+	err := r.Save(ctx, *ord, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { r.Delete(ctx, ord.OrderUID) })
+
+	// Оба способа должны собирать одинаковый заказ, иначе сравнивать нечего
+	single, err := r.GetByUID(ctx, ord.OrderUID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	perRow, err := getByUIDPerRow(ctx, r, ord.OrderUID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !SameOrder(single, perRow) {
+		b.Fatal("json_agg and per-row queries return different orders")
+	}
+
+	b.Run("json_agg", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := r.GetByUID(ctx, ord.OrderUID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per_row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := getByUIDPerRow(ctx, r, ord.OrderUID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package libr
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+/*
+CacheStore общий интерфейс кэшей: обычного Cache и ShardedCache.
+Skz работает с кэшем заказов через него, поэтому вид кэша выбирается при запуске.
+*/
+type CacheStore[K comparable, V any] interface {
+	Set(key K, value V, duration time.Duration)
+	Replace(key K, value V, duration time.Duration)
+	Get(key K) (V, bool)
+	GetOrLoad(key K, duration time.Duration, loader func(key K) (V, error)) (V, bool, error)
+	Delete(key K) error
+	Lookup(index, value string) []V
+	Len() int
+	Stats() CacheStats
+	Keys(limit int) []CacheKeyInfo[K]
+	Entries() []CacheEntry[K, V]
+	Restore(entries []CacheEntry[K, V]) int
+	Close()
+}
+
+/*
+ShardedCache кэш, разбитый на несколько Cache по хэшу ключа.
+У каждой части своя блокировка, свои лимиты и свой сборщик мусора,
+поэтому параллельные Get и Set по разным ключам друг друга почти не ждут.
+*/
+type ShardedCache[V any] struct {
+	shards []*Cache[string, V]
+}
+
+/*
+NewShardedCache создает кэш из shards частей. Лимиты MaxEntries и MaxBytes из opts делятся между частями,
+политика вытеснения для каждой части создается через opts.NewPolicy (один экземпляр Policy делить нельзя).
+*/
+func NewShardedCache[V any](shards int, opts CacheOptions[string, V]) *ShardedCache[V] {
+	if shards < 1 {
+		shards = 1
+	}
+	shardOpts := opts
+	shardOpts.Policy = nil
+	if opts.MaxEntries > 0 {
+		shardOpts.MaxEntries = (opts.MaxEntries + shards - 1) / shards
+	}
+	if opts.MaxBytes > 0 {
+		shardOpts.MaxBytes = (opts.MaxBytes + int64(shards) - 1) / int64(shards)
+	}
+	sc := &ShardedCache[V]{shards: make([]*Cache[string, V], shards)}
+	for i := range sc.shards {
+		sc.shards[i] = NewCacheWithOptions(shardOpts)
+	}
+	return sc
+}
+
+// shardIndex номер части кэша по хэшу ключа.
+func (sc *ShardedCache[V]) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(sc.shards)))
+}
+
+// shard выбирает часть кэша по хэшу ключа.
+func (sc *ShardedCache[V]) shard(key string) *Cache[string, V] {
+	return sc.shards[sc.shardIndex(key)]
+}
+
+// Set добавляет данные, если ключа еще нет, как Cache.Set.
+func (sc *ShardedCache[V]) Set(key string, value V, duration time.Duration) {
+	sc.shard(key).Set(key, value, duration)
+}
+
+// Replace записывает данные по ключу, даже если они уже есть.
+func (sc *ShardedCache[V]) Replace(key string, value V, duration time.Duration) {
+	sc.shard(key).Replace(key, value, duration)
+}
+
+// Get достает данные по ключу.
+func (sc *ShardedCache[V]) Get(key string) (V, bool) {
+	return sc.shard(key).Get(key)
+}
+
+// GetOrLoad достает данные по ключу или загружает их через loader, как Cache.GetOrLoad.
+func (sc *ShardedCache[V]) GetOrLoad(key string, duration time.Duration, loader func(key string) (V, error)) (V, bool, error) {
+	return sc.shard(key).GetOrLoad(key, duration, loader)
+}
+
+// Delete удаляет данные по ключу.
+func (sc *ShardedCache[V]) Delete(key string) error {
+	return sc.shard(key).Delete(key)
+}
+
+// Lookup ищет записи по вторичному индексу во всех частях.
+func (sc *ShardedCache[V]) Lookup(index, value string) []V {
+	found := make([]V, 0)
+	for _, c := range sc.shards {
+		found = append(found, c.Lookup(index, value)...)
+	}
+	return found
+}
+
+// Len возвращает число записей во всех частях.
+func (sc *ShardedCache[V]) Len() int {
+	n := 0
+	for _, c := range sc.shards {
+		n += c.Len()
+	}
+	return n
+}
+
+// Stats складывает статистику частей, возраст самой старой записи берется максимальный.
+func (sc *ShardedCache[V]) Stats() CacheStats {
+	var st CacheStats
+	for _, c := range sc.shards {
+		s := c.Stats()
+		st.Hits += s.Hits
+		st.Misses += s.Misses
+		st.Evictions += s.Evictions
+		st.Expirations += s.Expirations
+		st.Entries += s.Entries
+		st.Bytes += s.Bytes
+		if s.OldestAge > st.OldestAge {
+			st.OldestAge = s.OldestAge
+		}
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// Keys собирает ключи всех частей от старых записей к новым, limit <= 0 значит все.
+func (sc *ShardedCache[V]) Keys(limit int) []CacheKeyInfo[string] {
+	keys := make([]CacheKeyInfo[string], 0)
+	for _, c := range sc.shards {
+		keys = append(keys, c.Keys(limit)...)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Close останавливает сборщики мусора всех частей.
+func (sc *ShardedCache[V]) Close() {
+	for _, c := range sc.shards {
+		c.Close()
+	}
+}
+
+// Entries собирает неустаревшие записи всех частей для снимка.
+func (sc *ShardedCache[V]) Entries() []CacheEntry[string, V] {
+	entries := make([]CacheEntry[string, V], 0)
+	for _, c := range sc.shards {
+		entries = append(entries, c.Entries()...)
+	}
+	return entries
+}
+
+// Restore раскладывает записи из снимка по частям и возвращает число восстановленных.
+func (sc *ShardedCache[V]) Restore(entries []CacheEntry[string, V]) int {
+	parts := make([][]CacheEntry[string, V], len(sc.shards))
+	for _, e := range entries {
+		i := sc.shardIndex(e.Key)
+		parts[i] = append(parts[i], e)
+	}
+	n := 0
+	for i, c := range sc.shards {
+		n += c.Restore(parts[i])
+	}
+	return n
+}
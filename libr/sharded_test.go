@@ -0,0 +1,94 @@
+package libr
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchKeys = 10000
+
+// benchCacheParallel гоняет параллельные чтения и записи: каждая пятая операция Replace, остальные Get.
+func benchCacheParallel(b *testing.B, c CacheStore[string, Order]) {
+	keys := make([]string, benchKeys)
+	ord := *NewStrGen()
+	for i := range keys {
+		keys[i] = "order" + strconv.Itoa(i)
+		c.Replace(keys[i], ord, 0)
+	}
+	var seed uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&seed, 7919))
+		for pb.Next() {
+			i++
+			key := keys[i%benchKeys]
+			if i%5 == 0 {
+				c.Replace(key, ord, 0)
+			} else {
+				c.Get(key)
+			}
+		}
+	})
+}
+
+// benchOptions настройки кэша для бенчмарков: без политики Get берет блокировку на чтение, с LRU на запись.
+func benchOptions(policy string) CacheOptions[string, Order] {
+	opts := CacheOptions[string, Order]{DefaultExpiration: time.Hour}
+	if policy != "none" {
+		opts.MaxEntries = 2 * benchKeys
+		opts.NewPolicy = func() EvictionPolicy[string] {
+			p, _ := NewEvictionPolicy[string](policy)
+			return p
+		}
+	}
+	return opts
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, policy := range []string{"none", PolicyLRU} {
+		b.Run("policy="+policy, func(b *testing.B) {
+			c := NewCacheWithOptions(benchOptions(policy))
+			defer c.Close()
+			benchCacheParallel(b, c)
+		})
+	}
+}
+
+func BenchmarkShardedCacheParallel(b *testing.B) {
+	for _, policy := range []string{"none", PolicyLRU} {
+		for _, shards := range []int{4, 16, 64} {
+			b.Run("policy="+policy+"/shards="+strconv.Itoa(shards), func(b *testing.B) {
+				c := NewShardedCache(shards, benchOptions(policy))
+				defer c.Close()
+				benchCacheParallel(b, c)
+			})
+		}
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	c := NewShardedCache(8, CacheOptions[string, int]{MaxEntries: 80})
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+	}
+	// Лимит делится между частями, каждая держит не больше 10 записей
+	if n := c.Len(); n > 80 {
+		t.Fatalf("sharded cache holds %d entries, limit 80", n)
+	}
+	c.Replace("x", 1, 0)
+	if v, ok := c.Get("x"); !ok || v != 1 {
+		t.Fatalf("got %d, %v", v, ok)
+	}
+	if err := c.Delete("x"); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Entries != c.Len() || st.Hits != 1 {
+		t.Fatalf("bad stats %+v", st)
+	}
+	if keys := c.Keys(5); len(keys) != 5 {
+		t.Fatalf("got %d keys, want 5", len(keys))
+	}
+}
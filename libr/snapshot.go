@@ -0,0 +1,185 @@
+package libr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotFormatVersion версия формата файла со снимком кэша, снимки другой версии не читаются.
+const SnapshotFormatVersion = 1
+
+var (
+	// ErrSnapshotVersion снимок записан в другом формате.
+	ErrSnapshotVersion = errors.New("unsupported cache snapshot format version")
+	// ErrSnapshotCorrupt контрольная сумма снимка не совпадает с данными.
+	ErrSnapshotCorrupt = errors.New("cache snapshot checksum mismatch")
+	// ErrSnapshotTooOld снимок старше допустимого возраста.
+	ErrSnapshotTooOld = errors.New("cache snapshot is too old")
+)
+
+// CacheEntry запись кэша вместе со временем записи и истечения (0 для бессрочных), из них состоит снимок.
+type CacheEntry[K comparable, V any] struct {
+	Key        K         `json:"key"`
+	Value      V         `json:"value"`
+	Created    time.Time `json:"created"`
+	Expiration int64     `json:"expiration"`
+}
+
+/*
+cacheSnapshot содержимое файла снимка. Checksum это sha256 от Entries в том виде,
+в котором они записаны в файл, поэтому битый или недописанный файл не загрузится.
+*/
+type cacheSnapshot struct {
+	FormatVersion int             `json:"format_version"`
+	Created       time.Time       `json:"created"`
+	Checksum      string          `json:"checksum"`
+	Entries       json.RawMessage `json:"entries"`
+}
+
+// Entries возвращает неустаревшие записи кэша.
+func (c *Cache[K, V]) Entries() []CacheEntry[K, V] {
+	c.RLock()
+	defer c.RUnlock()
+	now := time.Now().UnixNano()
+	entries := make([]CacheEntry[K, V], 0, len(c.items))
+	for k, item := range c.items {
+		if item.Expiration > 0 && now > item.Expiration {
+			continue
+		}
+		entries = append(entries, CacheEntry[K, V]{Key: k, Value: item.Value, Created: item.Created, Expiration: item.Expiration})
+	}
+	return entries
+}
+
+/*
+Restore кладет в кэш записи из снимка с их прежним временем истечения, устаревшие пропускаются.
+Уже лежащие в кэше ключи не перезаписываются. Возвращает число восстановленных записей.
+*/
+func (c *Cache[K, V]) Restore(entries []CacheEntry[K, V]) int {
+	defer c.notifyRemoved()
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now().UnixNano()
+	n := 0
+	for _, e := range entries {
+		if e.Expiration > 0 && now > e.Expiration {
+			continue
+		}
+		if _, ok := c.items[e.Key]; ok {
+			continue
+		}
+		c.putLocked(e.Key, e.Value, e.Created, e.Expiration)
+		n++
+	}
+	return n
+}
+
+/*
+SaveSnapshot записывает кэш заказов в файл path. Сначала пишется временный файл рядом,
+потом он переименовывается, чтобы при падении посреди записи старый снимок остался целым.
+*/
+func (o *Skz) SaveSnapshot(path string) error {
+	entries, err := json.Marshal(o.Cash.Entries())
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(entries)
+	data, err := json.Marshal(cacheSnapshot{
+		FormatVersion: SnapshotFormatVersion,
+		Created:       time.Now(),
+		Checksum:      hex.EncodeToString(sum[:]),
+		Entries:       entries,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/*
+LoadSnapshot загружает кэш заказов из файла path и возвращает число восстановленных заказов.
+Снимок старше maxAge (если maxAge больше 0), другой версии формата или с неверной контрольной суммой
+не загружается, в этом случае кэш нужно наполнять из хранилища.
+*/
+func (o *Skz) LoadSnapshot(path string, maxAge time.Duration) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var snap cacheSnapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	if snap.FormatVersion != SnapshotFormatVersion {
+		return 0, fmt.Errorf("%w: %d, expected %d", ErrSnapshotVersion, snap.FormatVersion, SnapshotFormatVersion)
+	}
+	if maxAge > 0 && time.Since(snap.Created) > maxAge {
+		return 0, fmt.Errorf("%w: created %v", ErrSnapshotTooOld, snap.Created)
+	}
+	sum := sha256.Sum256(snap.Entries)
+	if hex.EncodeToString(sum[:]) != snap.Checksum {
+		return 0, ErrSnapshotCorrupt
+	}
+	var entries []CacheEntry[string, Order]
+	err = json.Unmarshal(snap.Entries, &entries)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	return o.Cash.Restore(entries), nil
+}
+
+/*
+WarmCache наполняет кэш при запуске: сначала из снимка path, а если его нет, он битый или устарел,
+то из хранилища через InitSomeCache. Пустой path сразу идет в хранилище.
+*/
+func (o *Skz) WarmCache(path string, maxAge time.Duration) error {
+	if path != "" {
+		n, err := o.LoadSnapshot(path, maxAge)
+		if err == nil {
+			fmt.Println(time.Now(), n, "orders loaded to cache from snapshot", path)
+			return nil
+		}
+		fmt.Println(time.Now(), "Cache snapshot is not usable, loading from database:", err)
+	}
+	return o.InitSomeCache()
+}
+
+// RunSnapshots раз в interval сохраняет снимок кэша в path, пока не отменят ctx.
+func (o *Skz) RunSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := o.SaveSnapshot(path)
+			if err != nil {
+				fmt.Println(time.Now(), "Saving cache snapshot failed:", err)
+			}
+		}
+	}
+}
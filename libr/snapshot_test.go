@@ -0,0 +1,97 @@
+package libr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rewriteSnapshot меняет записанный снимок через fn и сохраняет его обратно.
+func rewriteSnapshot(t *testing.T, path string, fn func(snap *cacheSnapshot)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap cacheSnapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	fn(&snap)
+	if data, err = json.Marshal(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		maxAge time.Duration
+		spoil  func(t *testing.T, path string)
+		err    error
+	}{
+		{"round trip", time.Minute, func(t *testing.T, path string) {}, nil},
+		{"any age", 0, func(t *testing.T, path string) {
+			rewriteSnapshot(t, path, func(snap *cacheSnapshot) { snap.Created = snap.Created.Add(-24 * time.Hour) })
+		}, nil},
+		{"too old", time.Minute, func(t *testing.T, path string) {
+			rewriteSnapshot(t, path, func(snap *cacheSnapshot) { snap.Created = snap.Created.Add(-time.Hour) })
+		}, ErrSnapshotTooOld},
+		{"format version", time.Minute, func(t *testing.T, path string) {
+			rewriteSnapshot(t, path, func(snap *cacheSnapshot) { snap.FormatVersion = SnapshotFormatVersion + 1 })
+		}, ErrSnapshotVersion},
+		{"checksum mismatch", time.Minute, func(t *testing.T, path string) {
+			rewriteSnapshot(t, path, func(snap *cacheSnapshot) { snap.Entries = json.RawMessage("[]") })
+		}, ErrSnapshotCorrupt},
+		{"truncated", time.Minute, func(t *testing.T, path string) {
+			data, _ := os.ReadFile(path)
+			os.WriteFile(path, data[:len(data)/2], 0o644)
+		}, ErrSnapshotCorrupt},
+		{"missing", time.Minute, func(t *testing.T, path string) { os.Remove(path) }, os.ErrNotExist},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.snapshot")
+			saved, _, _ := newTestSkz()
+			cachedOrd := *NewStrGen()
+			saved.Cash.Set(cachedOrd.OrderUID, cachedOrd, time.Minute)
+			if err := saved.SaveSnapshot(path); err != nil {
+				t.Fatal(err)
+			}
+			c.spoil(t, path)
+
+			// Новый запуск: в хранилище свой заказ, в кэш он попадает, только если снимок не подошел
+			o, repo, _ := newTestSkz()
+			o.Warm = WarmUpConfig{Strategy: WarmUpAll}
+			storedOrd := *NewStrGen()
+			if err := repo.Save(context.TODO(), storedOrd, 1); err != nil {
+				t.Fatal(err)
+			}
+			check, _, _ := newTestSkz()
+			_, err := check.LoadSnapshot(path, c.maxAge)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("LoadSnapshot: got %v, want %v", err, c.err)
+			}
+			if err = o.WarmCache(path, c.maxAge); err != nil {
+				t.Fatal(err)
+			}
+			_, fromSnapshot := o.Cash.Get(cachedOrd.OrderUID)
+			_, fromStorage := o.Cash.Get(storedOrd.OrderUID)
+			if fromSnapshot != (c.err == nil) || fromStorage != (c.err != nil) {
+				t.Fatalf("after WarmCache: snapshot order cached %v, stored order cached %v", fromSnapshot, fromStorage)
+			}
+			if c.err == nil {
+				got, _ := o.Cash.Get(cachedOrd.OrderUID)
+				if !SameOrder(got, cachedOrd) {
+					t.Fatal("restored order differs from saved")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package libr
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+FieldError ошибка проверки одного поля.
+Field записывается путем как в JSON модели, например "payment.amount" или "items[0].total_price".
+*/
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (fe FieldError) Error() string {
+	return fe.Field + ": " + fe.Message
+}
+
+// ValidationErrors список ошибок проверки заказа, реализует error.
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, len(ve))
+	for i, fe := range ve {
+		msgs[i] = fe.Error()
+	}
+	return "order is invalid: " + strings.Join(msgs, "; ")
+}
+
+// add дописывает ошибку поля в список.
+func (ve *ValidationErrors) add(field, format string, args ...interface{}) {
+	*ve = append(*ve, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required проверяет, что строковое поле не пустое и влезает в колонку БД.
+func (ve *ValidationErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		ve.add(field, "is required")
+		return
+	}
+	ve.maxLength(field, value)
+}
+
+// maxLength проверяет, что необязательное строковое поле влезает в колонку БД.
+func (ve *ValidationErrors) maxLength(field, value string) {
+	// VARCHAR(n) считает символы, а не байты
+	if utf8.RuneCountInString(value) > maxFieldLength {
+		ve.add(field, "is longer than %d characters", maxFieldLength)
+	}
+}
+
+// matches проверяет обязательное поле на соответствие формату.
+func (ve *ValidationErrors) matches(field, value string, re *regexp.Regexp, what string) {
+	if value == "" {
+		ve.add(field, "is required")
+		return
+	}
+	if !re.MatchString(value) {
+		ve.add(field, "%q is not a valid %s", value, what)
+		return
+	}
+	ve.maxLength(field, value)
+}
+
+// maxFieldLength соответствует VARCHAR(50) в таблицах.
+const maxFieldLength = 50
+
+var (
+	emailRe  = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phoneRe  = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+	zipRe    = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z -]{1,8}[0-9A-Za-z]$`)
+	localeRe = regexp.MustCompile(`^[a-z]{2}([-_][A-Z]{2})?$`)
+)
+
+// currencies коды валют ISO 4217.
+var currencies = map[string]bool{
+	"AED": true, "AFN": true, "ALL": true, "AMD": true, "ANG": true, "AOA": true, "ARS": true, "AUD": true, "AWG": true, "AZN": true,
+	"BAM": true, "BBD": true, "BDT": true, "BGN": true, "BHD": true, "BIF": true, "BMD": true, "BND": true, "BOB": true, "BRL": true,
+	"BSD": true, "BTN": true, "BWP": true, "BYN": true, "BZD": true, "CAD": true, "CDF": true, "CHF": true, "CLP": true, "CNY": true,
+	"COP": true, "CRC": true, "CUP": true, "CVE": true, "CZK": true, "DJF": true, "DKK": true, "DOP": true, "DZD": true, "EGP": true,
+	"ERN": true, "ETB": true, "EUR": true, "FJD": true, "FKP": true, "GBP": true, "GEL": true, "GHS": true, "GIP": true, "GMD": true,
+	"GNF": true, "GTQ": true, "GYD": true, "HKD": true, "HNL": true, "HTG": true, "HUF": true, "IDR": true, "ILS": true, "INR": true,
+	"IQD": true, "IRR": true, "ISK": true, "JMD": true, "JOD": true, "JPY": true, "KES": true, "KGS": true, "KHR": true, "KMF": true,
+	"KPW": true, "KRW": true, "KWD": true, "KYD": true, "KZT": true, "LAK": true, "LBP": true, "LKR": true, "LRD": true, "LSL": true,
+	"LYD": true, "MAD": true, "MDL": true, "MGA": true, "MKD": true, "MMK": true, "MNT": true, "MOP": true, "MRU": true, "MUR": true,
+	"MVR": true, "MWK": true, "MXN": true, "MYR": true, "MZN": true, "NAD": true, "NGN": true, "NIO": true, "NOK": true, "NPR": true,
+	"NZD": true, "OMR": true, "PAB": true, "PEN": true, "PGK": true, "PHP": true, "PKR": true, "PLN": true, "PYG": true, "QAR": true,
+	"RON": true, "RSD": true, "RUB": true, "RWF": true, "SAR": true, "SBD": true, "SCR": true, "SDG": true, "SEK": true, "SGD": true,
+	"SHP": true, "SLE": true, "SOS": true, "SRD": true, "SSP": true, "STN": true, "SVC": true, "SYP": true, "SZL": true, "THB": true,
+	"TJS": true, "TMT": true, "TND": true, "TOP": true, "TRY": true, "TTD": true, "TWD": true, "TZS": true, "UAH": true, "UGX": true,
+	"USD": true, "UYU": true, "UZS": true, "VES": true, "VND": true, "VUV": true, "WST": true, "XAF": true, "XCD": true, "XOF": true,
+	"XPF": true, "YER": true, "ZAR": true, "ZMW": true, "ZWL": true,
+}
+
+// ValidateOrderUID проверяет номер заказа, используется и для сообщений, и для Http запросов.
+func ValidateOrderUID(uid string) error {
+	var ve ValidationErrors
+	ve.required("order_uid", uid)
+	if ve != nil {
+		return ve
+	}
+	return nil
+}
+
+/*
+Validate проверяет заказ целиком: обязательные поля, форматы и согласованность сумм.
+Возвращает nil, если ошибок нет, иначе ValidationErrors со всеми найденными ошибками.
+*/
+func (ord Order) Validate() error {
+	var ve ValidationErrors
+	ve.required("order_uid", ord.OrderUID)
+	ve.required("track_number", ord.TrackNumber)
+	ve.required("entry", ord.Entry)
+	ve.matches("locale", ord.Locale, localeRe, "locale")
+	ve.required("customer_id", ord.CustomerID)
+	ve.required("delivery_service", ord.DeliveryService)
+	ve.maxLength("internal_signature", ord.InternalSignature)
+	ve.maxLength("shardkey", ord.Shardkey)
+	ve.maxLength("oof_shard", ord.OofShard)
+	if ord.Version < 0 {
+		ve.add("version", "must not be negative")
+	}
+	// Колонка version integer
+	if ord.Version > math.MaxInt32 {
+		ve.add("version", "must not be greater than %d", math.MaxInt32)
+	}
+	if ord.SmID < 0 {
+		ve.add("sm_id", "must not be negative")
+	}
+	if ord.DateCreated.IsZero() {
+		ve.add("date_created", "is required")
+	}
+	ord.Deliveries.validate(&ve, "delivery")
+	ord.Pays.validate(&ve, "payment")
+	if len(ord.Items) == 0 {
+		ve.add("items", "order must contain at least one item")
+	}
+	goodsTotal := 0
+	for i, it := range ord.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		it.validate(&ve, field)
+		if it.TrackNumber != "" && it.TrackNumber != ord.TrackNumber {
+			ve.add(field+".track_number", "%q does not match order track_number %q", it.TrackNumber, ord.TrackNumber)
+		}
+		goodsTotal += it.TotalPrice
+	}
+	if len(ord.Items) != 0 && ord.Pays.GoodsTotal != goodsTotal {
+		ve.add("payment.goods_total", "is %d, but items total_price sum is %d", ord.Pays.GoodsTotal, goodsTotal)
+	}
+	if amount := ord.Pays.GoodsTotal + ord.Pays.DeliveryCost + ord.Pays.CustomFee; ord.Pays.Amount != amount {
+		ve.add("payment.amount", "is %d, but goods_total + delivery_cost + custom_fee is %d", ord.Pays.Amount, amount)
+	}
+	if ve != nil {
+		return ve
+	}
+	return nil
+}
+
+// validate проверяет данные доставки, prefix добавляется к имени поля.
+func (d Delivery) validate(ve *ValidationErrors, prefix string) {
+	ve.required(prefix+".name", d.Name)
+	ve.matches(prefix+".phone", d.Phone, phoneRe, "phone number")
+	ve.matches(prefix+".zip", d.Zip, zipRe, "zip code")
+	ve.required(prefix+".city", d.City)
+	ve.required(prefix+".address", d.Address)
+	ve.required(prefix+".region", d.Region)
+	ve.matches(prefix+".email", d.Email, emailRe, "email")
+}
+
+// validate проверяет платеж без учета товаров, суммы сверяются в Order.Validate.
+func (p Payment) validate(ve *ValidationErrors, prefix string) {
+	ve.required(prefix+".transaction", p.Transaction)
+	ve.maxLength(prefix+".request_id", p.RequestID)
+	if p.Currency == "" {
+		ve.add(prefix+".currency", "is required")
+	} else if !currencies[p.Currency] {
+		ve.add(prefix+".currency", "%q is not an ISO 4217 currency code", p.Currency)
+	}
+	ve.required(prefix+".provider", p.Provider)
+	ve.required(prefix+".bank", p.Bank)
+	if p.PaymentDt <= 0 {
+		ve.add(prefix+".payment_dt", "must be a positive unix time")
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{{"amount", p.Amount}, {"delivery_cost", p.DeliveryCost}, {"goods_total", p.GoodsTotal}, {"custom_fee", p.CustomFee}} {
+		if f.value < 0 {
+			ve.add(prefix+"."+f.name, "must not be negative")
+		}
+	}
+}
+
+// validate проверяет товар, цена со скидкой должна совпадать с total_price.
+func (it Item) validate(ve *ValidationErrors, prefix string) {
+	if it.ChrtID <= 0 {
+		ve.add(prefix+".chrt_id", "must be positive")
+	}
+	ve.required(prefix+".track_number", it.TrackNumber)
+	ve.required(prefix+".rid", it.Rid)
+	ve.required(prefix+".name", it.Name)
+	ve.required(prefix+".brand", it.Brand)
+	ve.maxLength(prefix+".size", it.Size)
+	if it.NmID <= 0 {
+		ve.add(prefix+".nm_id", "must be positive")
+	}
+	if it.Price < 0 {
+		ve.add(prefix+".price", "must not be negative")
+	}
+	if it.Sale < 0 || it.Sale > 100 {
+		ve.add(prefix+".sale", "must be a percent between 0 and 100")
+		return
+	}
+	if total := it.Price * (100 - it.Sale) / 100; it.TotalPrice != total {
+		ve.add(prefix+".total_price", "is %d, but price with sale is %d", it.TotalPrice, total)
+	}
+}
@@ -0,0 +1,53 @@
+package libr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateGeneratedOrder(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ord := NewStrGen()
+		if err := ord.Validate(); err != nil {
+			t.Fatalf("generated order is invalid: %v", err)
+		}
+	}
+}
+
+func TestValidateFieldLength(t *testing.T) {
+	long := strings.Repeat("a", maxFieldLength+1)
+	cases := map[string]func(ord *Order){
+		"delivery.email":     func(ord *Order) { ord.Deliveries.Email = long + "@example.com" },
+		"payment.request_id": func(ord *Order) { ord.Pays.RequestID = long },
+		"items[0].size":      func(ord *Order) { ord.Items[0].Size = long },
+		"internal_signature": func(ord *Order) { ord.InternalSignature = long },
+		"shardkey":           func(ord *Order) { ord.Shardkey = long },
+		"oof_shard":          func(ord *Order) { ord.OofShard = long },
+	}
+	for field, change := range cases {
+		ord := NewStrGen()
+		change(ord)
+		var ve ValidationErrors
+		if !errors.As(ord.Validate(), &ve) {
+			t.Errorf("%s: long value passed validation", field)
+			continue
+		}
+		if len(ve) != 1 || ve[0].Field != field {
+			t.Errorf("%s: got errors %v", field, ve)
+		}
+	}
+}
+
+func TestValidateCountsCharacters(t *testing.T) {
+	// 50 кириллических букв это 100 байт, но в VARCHAR(50) они влезают
+	ord := NewStrGen()
+	ord.Deliveries.City = strings.Repeat("я", maxFieldLength)
+	if err := ord.Validate(); err != nil {
+		t.Fatalf("50 characters must fit: %v", err)
+	}
+	ord.Deliveries.City += "я"
+	if ord.Validate() == nil {
+		t.Fatal("51 characters must not fit")
+	}
+}
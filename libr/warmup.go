@@ -0,0 +1,77 @@
+package libr
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Стратегии прогрева кэша при запуске.
+const (
+	// WarmUpRecent грузит Count самых свежих заказов.
+	WarmUpRecent = "recent"
+	// WarmUpWindow грузит заказы, созданные за последние Window.
+	WarmUpWindow = "window"
+	// WarmUpAll грузит все заказы.
+	WarmUpAll = "all"
+	// WarmUpNone оставляет кэш пустым, заказы попадут в него при первом запросе.
+	WarmUpNone = "none"
+)
+
+/*
+WarmUpConfig настройки прогрева кэша в InitSomeCache.
+При Background прогрев идет в отдельной рутине и InitSomeCache сразу возвращается,
+так что сервер начинает отвечать, не дожидаясь конца загрузки.
+*/
+type WarmUpConfig struct {
+	Strategy   string
+	Count      int
+	Window     time.Duration
+	Background bool
+}
+
+// Check проверяет, что стратегия известна и для нее заданы нужные параметры.
+func (w WarmUpConfig) Check() error {
+	switch w.Strategy {
+	case WarmUpRecent:
+		if w.Count <= 0 {
+			return fmt.Errorf("warm-up strategy %q needs positive count", w.Strategy)
+		}
+	case WarmUpWindow:
+		if w.Window <= 0 {
+			return fmt.Errorf("warm-up strategy %q needs positive window", w.Strategy)
+		}
+	case WarmUpAll, WarmUpNone:
+	default:
+		return fmt.Errorf("unknown warm-up strategy %q, expected %s, %s, %s or %s", w.Strategy, WarmUpRecent, WarmUpWindow, WarmUpAll, WarmUpNone)
+	}
+	return nil
+}
+
+/*
+WarmUp загружает заказы из хранилища в кэш по стратегии cfg и возвращает число загруженных.
+Заказы кладутся в кэш по одному по мере чтения, поэтому уже загруженные сразу доступны для запросов.
+*/
+func (o *Skz) WarmUp(ctx context.Context, cfg WarmUpConfig) (int, error) {
+	err := cfg.Check()
+	if err != nil {
+		return 0, err
+	}
+	var since time.Time
+	limit := 0
+	switch cfg.Strategy {
+	case WarmUpNone:
+		return 0, nil
+	case WarmUpRecent:
+		limit = cfg.Count
+	case WarmUpWindow:
+		since = time.Now().Add(-cfg.Window)
+	}
+	n := 0
+	err = o.Repo.Recent(ctx, since, limit, func(ord Order) error {
+		o.Cash.Set(ord.OrderUID, ord, orderTTL)
+		n++
+		return nil
+	})
+	return n, err
+}
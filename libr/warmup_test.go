@@ -0,0 +1,112 @@
+package libr
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saveAged сохраняет заказы, созданные час, два часа и так далее назад, первым идет самый свежий.
+func saveAged(t *testing.T, repo *MemoryRepository, n int) []Order {
+	t.Helper()
+	list := make([]Order, n)
+	for i := range list {
+		list[i] = *NewStrGen()
+		list[i].DateCreated = time.Now().Add(-time.Duration(i+1) * time.Hour)
+		if err := repo.Save(context.TODO(), list[i], uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return list
+}
+
+// cachedUIDs номера заказов из списка, которые есть в кэше, через запятую.
+func cachedUIDs(o *Skz, list []Order) string {
+	found := make([]string, 0)
+	for _, ord := range list {
+		if _, ok := o.Cash.Get(ord.OrderUID); ok {
+			found = append(found, ord.OrderUID)
+		}
+	}
+	sort.Strings(found)
+	return strings.Join(found, ",")
+}
+
+func uidsOf(list []Order) string {
+	uids := make([]string, 0, len(list))
+	for _, ord := range list {
+		uids = append(uids, ord.OrderUID)
+	}
+	sort.Strings(uids)
+	return strings.Join(uids, ",")
+}
+
+func TestWarmUp(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		cfg    WarmUpConfig
+		loaded int
+		bad    bool
+	}{
+		{"recent", WarmUpConfig{Strategy: WarmUpRecent, Count: 2}, 2, false},
+		{"recent more than stored", WarmUpConfig{Strategy: WarmUpRecent, Count: 10}, 5, false},
+		{"window", WarmUpConfig{Strategy: WarmUpWindow, Window: 150 * time.Minute}, 2, false},
+		{"all", WarmUpConfig{Strategy: WarmUpAll}, 5, false},
+		{"none", WarmUpConfig{Strategy: WarmUpNone}, 0, false},
+		{"recent without count", WarmUpConfig{Strategy: WarmUpRecent}, 0, true},
+		{"window without window", WarmUpConfig{Strategy: WarmUpWindow}, 0, true},
+		{"unknown", WarmUpConfig{Strategy: "oldest"}, 0, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			o, repo, _ := newTestSkz()
+			list := saveAged(t, repo, 5)
+			n, err := o.WarmUp(context.TODO(), c.cfg)
+			if (err != nil) != c.bad || n != c.loaded {
+				t.Fatalf("got %d orders, error %v", n, err)
+			}
+			// Стратегии берут самые свежие заказы, list отсортирован от свежих к старым
+			if got, want := cachedUIDs(o, list), uidsOf(list[:c.loaded]); got != want {
+				t.Fatalf("cached %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestWarmUpKeepsNewestInFullCache(t *testing.T) {
+	o := NewSkzWithCache(Connector{}, CacheOptions[string, Order]{DefaultExpiration: time.Minute, MaxEntries: 2}, 1)
+	repo := NewMemoryRepository()
+	o.Repo = repo
+	list := saveAged(t, repo, 5)
+	n, err := o.WarmUp(context.TODO(), WarmUpConfig{Strategy: WarmUpAll})
+	if err != nil || n != 5 {
+		t.Fatalf("got %d orders, error %v", n, err)
+	}
+	// Заказы идут от старых к новым, поэтому вытесняются старые
+	if got, want := cachedUIDs(o, list), uidsOf(list[:2]); got != want {
+		t.Fatalf("cached %s, want %s", got, want)
+	}
+}
+
+func TestWarmUpBackground(t *testing.T) {
+	o, repo, _ := newTestSkz()
+	list := saveAged(t, repo, 5)
+	o.Warm = WarmUpConfig{Strategy: WarmUpAll, Background: true}
+	if err := o.InitSomeCache(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for cachedUIDs(o, list) != uidsOf(list) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background warm-up cached only %s", cachedUIDs(o, list))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Ошибка настроек видна сразу, даже при прогреве в фоне
+	o.Warm = WarmUpConfig{Strategy: WarmUpRecent, Background: true}
+	if err := o.InitSomeCache(); err == nil {
+		t.Fatal("bad warm-up config accepted")
+	}
+}
@@ -35,6 +35,20 @@ func main() {
 		// сообщение об индексе заказа и его уникальный номер, отсюда можно брать информацию, чтобы потом на сайте
 		// посмотреть успешно добавилось в базу данных и/или кэш или нет
 		fmt.Println(time.Now(), "Index =", i, "OrderUID =", GeneratedOrder.OrderUID)
+		// каждый пятый заказ сразу исправляем: меняем адрес доставки и отправляем обновление до версии 2
+		if i%5 == 0 {
+			Updated := *GeneratedOrder
+			Updated.Deliveries.Address = "corrected " + Updated.Deliveries.Address
+			JsonUpdate, err := json.Marshal(libr.NewUpdateEvent(Updated, 2))
+			if err != nil {
+				fmt.Println(time.Now(), "JSON err:", err)
+			}
+			err = StreamConnection.Publish("foo", JsonUpdate)
+			if err != nil {
+				fmt.Println(time.Now(), "Publish err:", err)
+			}
+			fmt.Println(time.Now(), "Index =", i, "OrderUID =", GeneratedOrder.OrderUID, "updated to version 2")
+		}
 		// частота сообщений пока регулируется этим sleep'ом можно менять значения, но у меня тормознутый комп
 		// поэтому Я оставлю 30 секунд
 		time.Sleep(30 * time.Second)